@@ -0,0 +1,558 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Purpose of the signed links sent to approvers
+const accessDecisionLinkPurpose = "access-decision"
+
+var testLastSentNotice = ""
+
+// accessRequest is a request to be allowed to log in from someone not on the allowlist, waiting for a decision
+type accessRequest struct {
+	ID      string    `json:"id"`
+	Email   string    `json:"email"`
+	Reason  string    `json:"reason"`
+	IP      string    `json:"ip,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+// accessGrant is an email on the dynamic allowlist, kept in the session store instead of the configuration
+type accessGrant struct {
+	Email     string    `json:"email"`
+	GrantedBy string    `json:"granted_by"`
+	Reason    string    `json:"reason,omitempty"`
+	Granted   time.Time `json:"granted"`
+	// Zero if the access does not expire
+	ValidUntil time.Time `json:"valid_until"`
+	// Groups the email was invited to, the access ends with the groups
+	Groups []string `json:"groups,omitempty"`
+	// The invitation the access came from, so following its link again only sends a new code
+	InvitationID string `json:"invitation_id,omitempty"`
+	// When the access was revoked, invitations made before then no longer give it back
+	Revoked time.Time `json:"revoked"`
+}
+
+func (g *accessGrant) active(now time.Time) bool {
+	return g.ValidUntil.IsZero() || now.Before(g.ValidUntil)
+}
+
+// accessStore keeps the pending access requests and the dynamic allowlist
+type accessStore interface {
+	// putAccessRequest records a new access request
+	putAccessRequest(request *accessRequest) error
+	// getAccessRequest finds a pending request, nil if it is not known or has expired
+	getAccessRequest(id string) (*accessRequest, error)
+	// takeAccessRequest removes a pending request so it is only decided once, nil if it is not known or has expired
+	takeAccessRequest(id string) (*accessRequest, error)
+	// putAccessGrant adds or replaces the email on the dynamic allowlist
+	putAccessGrant(grant *accessGrant) error
+	// getAccessGrant finds the email on the dynamic allowlist, nil if it is not there
+	getAccessGrant(email string) (*accessGrant, error)
+	// listAccessGrants gets everything on the dynamic allowlist, including expired entries
+	listAccessGrants() ([]*accessGrant, error)
+	// closeInvitation marks the invitation as used or cancelled until its link expires, reporting if it already was
+	closeInvitation(id string, expires time.Time) (bool, error)
+	// invitationClosed checks if the invitation has been used or cancelled
+	invitationClosed(id string) (bool, error)
+}
+
+func (ms *memorySessionStore) putAccessRequest(request *accessRequest) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.accessRequests[request.ID] = *request
+	return nil
+}
+
+func (ms *memorySessionStore) getAccessRequest(id string) (*accessRequest, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	request, ok := ms.accessRequests[id]
+	if !ok || time.Now().After(request.Expires) {
+		return nil, nil
+	}
+	return &request, nil
+}
+
+func (ms *memorySessionStore) takeAccessRequest(id string) (*accessRequest, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	request, ok := ms.accessRequests[id]
+	delete(ms.accessRequests, id)
+	if !ok || time.Now().After(request.Expires) {
+		return nil, nil
+	}
+	return &request, nil
+}
+
+func (ms *memorySessionStore) putAccessGrant(grant *accessGrant) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.accessGrants[grant.Email] = *grant
+	return nil
+}
+
+func (ms *memorySessionStore) getAccessGrant(email string) (*accessGrant, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	grant, ok := ms.accessGrants[email]
+	if !ok {
+		return nil, nil
+	}
+	return &grant, nil
+}
+
+func (ms *memorySessionStore) listAccessGrants() ([]*accessGrant, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	var grants []*accessGrant
+	for _, g := range ms.accessGrants {
+		grant := g
+		grants = append(grants, &grant)
+	}
+	return grants, nil
+}
+
+func (ms *memorySessionStore) closeInvitation(id string, expires time.Time) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if _, ok := ms.closedInvitations[id]; ok {
+		return true, nil
+	}
+	ms.closedInvitations[id] = expires
+	return false, nil
+}
+
+func (ms *memorySessionStore) invitationClosed(id string) (bool, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	_, ok := ms.closedInvitations[id]
+	return ok, nil
+}
+
+var (
+	accessRequestsBucket    = []byte("access_requests")
+	accessGrantsBucket      = []byte("access_grants")
+	closedInvitationsBucket = []byte("closed_invitations")
+)
+
+// getJSON reads the value of the key in the bucket, reporting if it was found
+func getJSON(bucket *bolt.Bucket, key string, value interface{}) (bool, error) {
+	data := bucket.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, value)
+}
+
+// putJSON writes the value to the key in the bucket
+func putJSON(bucket *bolt.Bucket, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(key), data)
+}
+
+func (fs *fileSessionStore) putAccessRequest(request *accessRequest) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(accessRequestsBucket), request.ID, request)
+	})
+}
+
+func (fs *fileSessionStore) getAccessRequest(id string) (*accessRequest, error) {
+	request := &accessRequest{}
+	found := false
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getJSON(tx.Bucket(accessRequestsBucket), id, request)
+		return err
+	})
+	if err != nil || !found || time.Now().After(request.Expires) {
+		return nil, err
+	}
+	return request, nil
+}
+
+func (fs *fileSessionStore) takeAccessRequest(id string) (*accessRequest, error) {
+	request := &accessRequest{}
+	found := false
+	err := fs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(accessRequestsBucket)
+
+		var err error
+		found, err = getJSON(bucket, id, request)
+		if err != nil || !found {
+			return err
+		}
+		return bucket.Delete([]byte(id))
+	})
+	if err != nil || !found || time.Now().After(request.Expires) {
+		return nil, err
+	}
+	return request, nil
+}
+
+func (fs *fileSessionStore) putAccessGrant(grant *accessGrant) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(accessGrantsBucket), grant.Email, grant)
+	})
+}
+
+func (fs *fileSessionStore) getAccessGrant(email string) (*accessGrant, error) {
+	grant := &accessGrant{}
+	found := false
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		found, err = getJSON(tx.Bucket(accessGrantsBucket), email, grant)
+		return err
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return grant, nil
+}
+
+func (fs *fileSessionStore) listAccessGrants() ([]*accessGrant, error) {
+	var grants []*accessGrant
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(accessGrantsBucket).ForEach(func(_ []byte, value []byte) error {
+			grant := &accessGrant{}
+			if err := json.Unmarshal(value, grant); err != nil {
+				return err
+			}
+			grants = append(grants, grant)
+			return nil
+		})
+	})
+	return grants, err
+}
+
+func (fs *fileSessionStore) closeInvitation(id string, expires time.Time) (bool, error) {
+	closed := false
+	err := fs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(closedInvitationsBucket)
+		if bucket.Get([]byte(id)) != nil {
+			closed = true
+			return nil
+		}
+		return putJSON(bucket, id, expires)
+	})
+	return closed, err
+}
+
+func (fs *fileSessionStore) invitationClosed(id string) (bool, error) {
+	closed := false
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		closed = tx.Bucket(closedInvitationsBucket).Get([]byte(id)) != nil
+		return nil
+	})
+	return closed, err
+}
+
+// accessDecisionLink is carried by the signed links sent to approvers
+type accessDecisionLink struct {
+	RequestID string `json:"rid"`
+	Approve   bool   `json:"approve"`
+	Approver  string `json:"approver"`
+}
+
+// accessDecisionURL creates the link for the approver to make the decision on the request
+func accessDecisionURL(srv *Server, request *accessRequest, approver string, approve bool) (string, error) {
+	link := accessDecisionLink{RequestID: request.ID, Approve: approve, Approver: approver}
+	token, err := srv.signingKeys().signLink(accessDecisionLinkPurpose, link, request.Expires)
+	if err != nil {
+		return "", err
+	}
+	return publicURL(srv.Config, "/access/?token="+url.QueryEscape(token)), nil
+}
+
+// sendNotice sends a plain text email, e.g. to approvers of access requests
+func sendNotice(ctx context.Context, srv *Server, email string, subject string, text string) {
+	slog.DebugContext(ctx, "New notice", slog.String("email", email), slog.String("subject", subject))
+
+	testLastSentNotice = text
+
+	if skipSending(email) {
+		return
+	}
+
+	provider := srv.Config.Email.EmailProvider
+	var err error
+	if provider == "mailjet" {
+		err = srv.MailjetSender.sendTextEmail(email, subject, text)
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send notice", slog.String("provider", provider), slog.Any("error", err))
+	}
+}
+
+// notifyApprovers sends each approver their own links to approve or deny the request
+func notifyApprovers(ctx context.Context, srv *Server, request *accessRequest) error {
+	subject := fmt.Sprintf("%s access request from %s", srv.Config.Brand, request.Email)
+
+	for _, approver := range srv.Config.AccessRequests.Approvers {
+		approveURL, err := accessDecisionURL(srv, request, approver, true)
+		if err != nil {
+			return err
+		}
+		denyURL, err := accessDecisionURL(srv, request, approver, false)
+		if err != nil {
+			return err
+		}
+
+		text := fmt.Sprintf("%s has requested access to %s.\n\nReason: %s\n\nApprove: %s\n\nDeny: %s\n\nThe links are valid until %s.",
+			request.Email, srv.Config.Brand, request.Reason, approveURL, denyURL, request.Expires.Format(time.RFC1123))
+		sendNotice(ctx, srv, approver, subject, text)
+	}
+	return nil
+}
+
+// grantValidUntil works out when newly granted access expires, zero if it does not
+func grantValidUntil(srv *Server, now time.Time) time.Time {
+	if srv.Config.AccessRequests.GrantDays == 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, srv.Config.AccessRequests.GrantDays)
+}
+
+// dynamicAccess finds the email on the dynamic allowlist, unless deny rules in the configuration block it
+func dynamicAccess(srv *Server, email string) (*accessGrant, error) {
+	if denied, _ := srv.emailAllowlist().denied(email); denied {
+		return nil, nil
+	}
+	return srv.sessionStorage().getAccessGrant(email)
+}
+
+// grantActive checks the access on the dynamic allowlist is in effect, including the validity of the groups the
+// email was invited to. Access through groups no longer in the configuration is not.
+func grantActive(srv *Server, grant *accessGrant, now time.Time) bool {
+	if !grant.active(now) {
+		return false
+	}
+
+	al := srv.emailAllowlist()
+	for _, name := range grant.Groups {
+		groupValidity, ok := al.groups[name]
+		if !ok || !groupValidity.active(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortAccessGrants orders the grants by email
+func sortAccessGrants(grants []*accessGrant) {
+	sort.Slice(grants, func(i, j int) bool {
+		return grants[i].Email < grants[j].Email
+	})
+}
+
+// openAccessDecision reads the decision link, nil if it is not valid
+func openAccessDecision(srv *Server, r *http.Request, token string) *accessDecisionLink {
+	link := &accessDecisionLink{}
+	if err := srv.signingKeys().openLink(accessDecisionLinkPurpose, token, link); err != nil {
+		slog.DebugContext(r.Context(), "Invalid access decision link", slog.Any("error", err))
+		return nil
+	}
+	return link
+}
+
+func registerAccessRoutes(srv *Server, r *chi.Mux) {
+	ipLimiter := newRateLimiter()
+	emailLimiter := newRateLimiter()
+
+	r.Route("/api/access", func(r chi.Router) {
+		r.Use(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !srv.Config.AccessRequests.Enabled {
+					http.NotFound(w, r)
+					return
+				}
+				next.ServeHTTP(w, r)
+			})
+		})
+
+		// Request access, approvers are only notified if the email is not already allowed
+		r.Post("/request", func(w http.ResponseWriter, r *http.Request) {
+			var req accessRequestRequest
+			if r.Body == nil || json.NewDecoder(r.Body).Decode(&req) != nil || !validateRequest(r.Context(), req) {
+				w.WriteHeader(400)
+				return
+			}
+
+			email, err := normalizeEmail(srv.Config.Email, req.Email)
+			if err != nil {
+				slog.DebugContext(r.Context(), "Invalid email", slog.String("email", req.Email), slog.Any("error", err))
+				w.WriteHeader(400)
+				return
+			}
+
+			if rateLimited(srv, w, r, ipLimiter, "ip", clientIP(r)) || rateLimited(srv, w, r, emailLimiter, "email", email) {
+				return
+			}
+
+			// The response is the same either way so it can't be used to find out who is allowed
+			if denied, _ := srv.emailAllowlist().denied(email); denied || emailAllowed(srv, email) {
+				slog.DebugContext(r.Context(), "Ignoring access request", slog.String("email", email), slog.Bool("denied", denied))
+				w.WriteHeader(204)
+				return
+			}
+
+			now := time.Now()
+			request := &accessRequest{
+				ID:      uuid.New().String(),
+				Email:   email,
+				Reason:  strings.TrimSpace(req.Reason),
+				IP:      clientIP(r),
+				Created: now,
+				Expires: now.Add(time.Duration(srv.Config.AccessRequests.RequestValidHours) * time.Hour),
+			}
+
+			if err := srv.sessionStorage().putAccessRequest(request); err != nil {
+				slog.ErrorContext(r.Context(), "Error storing access request", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			srv.audit.record(r, auditAccessRequested, email, slog.String("request_id", request.ID))
+
+			if err := notifyApprovers(r.Context(), srv, request); err != nil {
+				slog.ErrorContext(r.Context(), "Error notifying approvers", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(204)
+		})
+
+		// Show the request behind a decision link, so following the link does not decide anything by itself
+		r.Get("/decision", func(w http.ResponseWriter, r *http.Request) {
+			link := openAccessDecision(srv, r, r.URL.Query().Get("token"))
+			if link == nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			request, err := srv.sessionStorage().getAccessRequest(link.RequestID)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error getting access request", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+			if request == nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			response := accessDecisionResponse{
+				Email:   request.Email,
+				Reason:  request.Reason,
+				Created: request.Created,
+				Approve: link.Approve,
+			}
+			if validUntil := grantValidUntil(srv, time.Now()); !validUntil.IsZero() {
+				response.ValidUntil = &validUntil
+			}
+
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+		})
+
+		// Apply the decision of the link
+		r.Post("/decide", func(w http.ResponseWriter, r *http.Request) {
+			var req accessDecideRequest
+			if r.Body == nil || json.NewDecoder(r.Body).Decode(&req) != nil || !validateRequest(r.Context(), req) {
+				w.WriteHeader(400)
+				return
+			}
+
+			link := openAccessDecision(srv, r, req.Token)
+			if link == nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			// Taking the request ensures it is only decided once, e.g. by the first of the approvers
+			request, err := srv.sessionStorage().takeAccessRequest(link.RequestID)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error getting access request", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+			if request == nil {
+				http.NotFound(w, r)
+				return
+			}
+
+			if !link.Approve {
+				srv.audit.record(r, auditAccessDenied, request.Email, slog.String("request_id", request.ID), slog.String("approver", link.Approver))
+				sendNotice(r.Context(), srv, request.Email, fmt.Sprintf("%s access request", srv.Config.Brand),
+					fmt.Sprintf("Your request for access to %s was not approved. Please contact %s for more information.", srv.Config.Brand, srv.Config.Support))
+				w.WriteHeader(204)
+				return
+			}
+
+			now := time.Now()
+			grant := &accessGrant{
+				Email:      request.Email,
+				GrantedBy:  link.Approver,
+				Reason:     request.Reason,
+				Granted:    now,
+				ValidUntil: grantValidUntil(srv, now),
+			}
+			if err := srv.sessionStorage().putAccessGrant(grant); err != nil {
+				slog.ErrorContext(r.Context(), "Error granting access", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			srv.audit.record(r, auditAccessApproved, request.Email, slog.String("request_id", request.ID), slog.String("approver", link.Approver))
+			sendNotice(r.Context(), srv, request.Email, fmt.Sprintf("%s access request", srv.Config.Brand),
+				fmt.Sprintf("Your request for access to %s was approved, you can now log in at %s", srv.Config.Brand, publicURL(srv.Config, "/")))
+			w.WriteHeader(204)
+		})
+	})
+}
+
+var errAccessGrantNotFound = errors.New("access grant not found")
+
+// revokeAccessGrant expires the email's access on the dynamic allowlist, so its tokens also stop working
+func revokeAccessGrant(srv *Server, email string) error {
+	grant, err := srv.sessionStorage().getAccessGrant(email)
+	if err != nil {
+		return err
+	}
+	if grant == nil {
+		return errAccessGrantNotFound
+	}
+
+	now := time.Now()
+	grant.ValidUntil = now
+	grant.Revoked = now
+	return srv.sessionStorage().putAccessGrant(grant)
+}
@@ -0,0 +1,160 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// requireAdmin only lets requests with the configured admin token through
+func requireAdmin(srv *Server) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || srv.Config.Admin.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(srv.Config.Admin.Token)) != 1 {
+				slog.WarnContext(r.Context(), "Admin API authentication failed", slog.String("client_ip", clientIP(r)))
+				authFailed(w)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func registerAdminRoutes(srv *Server, r *chi.Mux) {
+	r.Route("/api/admin", func(r chi.Router) {
+		r.Use(requireAdmin(srv))
+
+		// Get the current debug logging state
+		r.Get("/debug", func(w http.ResponseWriter, r *http.Request) {
+			err := json.NewEncoder(w).Encode(adminDebugResponse{
+				Enabled: logLevel.Level() <= slog.LevelDebug,
+				DevMode: srv.Config.DevMode,
+			})
+			if err != nil {
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+		})
+
+		// Toggle debug logging at runtime, until the next reload or restart
+		r.Put("/debug", func(w http.ResponseWriter, r *http.Request) {
+			if r.Body == nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			var req adminDebugRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			if req.Enabled {
+				logLevel.Set(slog.LevelDebug)
+			} else {
+				logLevel.Set(srv.configuredLogLevel(srv.Config.Log))
+			}
+
+			slog.InfoContext(r.Context(), "Debug logging toggled", slog.Bool("enabled", req.Enabled))
+			w.WriteHeader(204)
+		})
+
+		// List the dynamic allowlist
+		r.Get("/access", func(w http.ResponseWriter, r *http.Request) {
+			grants, err := srv.sessionStorage().listAccessGrants()
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error listing access grants", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+			sortAccessGrants(grants)
+
+			now := time.Now()
+			response := []accessGrantResponse{}
+			for _, grant := range grants {
+				response = append(response, accessGrantResponse{
+					Email:      grant.Email,
+					GrantedBy:  grant.GrantedBy,
+					Reason:     grant.Reason,
+					Granted:    grant.Granted,
+					ValidUntil: grant.ValidUntil,
+					Groups:     grant.Groups,
+					Active:     grantActive(srv, grant, now),
+				})
+			}
+
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+		})
+
+		// Invite an email to log in, the link adds it to the dynamic allowlist
+		r.Post("/invitations", func(w http.ResponseWriter, r *http.Request) {
+			var req adminInvitationRequest
+			if r.Body == nil || json.NewDecoder(r.Body).Decode(&req) != nil || !validateRequest(r.Context(), req) {
+				w.WriteHeader(400)
+				return
+			}
+
+			response, err := inviteEmail(srv, r, req)
+			if err != nil {
+				slog.InfoContext(r.Context(), "Invalid invitation", slog.String("email", req.Email), slog.Any("error", err))
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+		})
+
+		// Cancel a pending invitation, access from accepted ones is revoked like any other
+		r.Delete("/invitations/{id}", func(w http.ResponseWriter, r *http.Request) {
+			id := chi.URLParam(r, "id")
+			if _, err := uuid.Parse(id); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			if err := cancelInvitation(srv, id); err != nil {
+				slog.ErrorContext(r.Context(), "Error cancelling invitation", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			srv.audit.record(r, auditInvitationEnded, "", slog.String("invitation_id", id))
+			w.WriteHeader(204)
+		})
+
+		// Revoke access from the dynamic allowlist, also ending the sessions of the email
+		r.Delete("/access/{email}", func(w http.ResponseWriter, r *http.Request) {
+			email, err := normalizeEmail(srv.Config.Email, chi.URLParam(r, "email"))
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			err = revokeAccessGrant(srv, email)
+			if errors.Is(err, errAccessGrantNotFound) {
+				http.NotFound(w, r)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error revoking access", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			slog.InfoContext(r.Context(), "Access revoked", slog.String("email", email))
+			w.WriteHeader(204)
+		})
+	})
+}
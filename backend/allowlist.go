@@ -0,0 +1,690 @@
+package backend
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// How long to wait for changes to the allowlist files to settle before reloading them
+const allowlistReloadDelay = 250 * time.Millisecond
+
+// emailPattern matches normalized emails, either a glob like contractor-*@corp.example where * and ? match any
+// characters, or a regular expression written between slashes like /^[a-z]+@corp\.example$/. Globs match the whole
+// address, regular expressions are not anchored unless they are written with ^ and $.
+type emailPattern struct {
+	source string
+	regex  *regexp.Regexp
+}
+
+func newEmailPattern(source string) (emailPattern, error) {
+	pattern := emailPattern{source: source}
+
+	if len(source) > 2 && strings.HasPrefix(source, "/") && strings.HasSuffix(source, "/") {
+		// Emails are compared in lowercase, so the regular expressions ignore case to match them as written
+		regex, err := regexp.Compile("(?i)" + source[1:len(source)-1])
+		if err != nil {
+			return pattern, fmt.Errorf("invalid regular expression %s: %w", source, err)
+		}
+		pattern.regex = regex
+		return pattern, nil
+	}
+
+	// Emails are compared in lowercase so the globs need to be too
+	expr, err := globRegexp(strings.ToLower(source))
+	if err != nil {
+		return pattern, fmt.Errorf("invalid pattern %s: %w", source, err)
+	}
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return pattern, fmt.Errorf("invalid pattern %s: %w", source, err)
+	}
+	pattern.regex = regex
+	return pattern, nil
+}
+
+// globRegexp translates the glob to an anchored regular expression. Unlike with path.Match, * also matches slashes,
+// which are valid in the local part of email addresses.
+func globRegexp(glob string) (string, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		case '[':
+			class, n, err := globClass(glob[i:])
+			if err != nil {
+				return "", err
+			}
+			expr.WriteString(class)
+			i += n - 1
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+			}
+			fallthrough
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	expr.WriteString("$")
+	return expr.String(), nil
+}
+
+// globClass translates the character class at the start of the glob, e.g. [a-z] or [^0-9], to a regular expression,
+// also giving the length of the class in the glob
+func globClass(glob string) (string, int, error) {
+	var class strings.Builder
+	class.WriteString("[")
+
+	i := 1
+	if i < len(glob) && glob[i] == '^' {
+		class.WriteString("^")
+		i++
+	}
+
+	// Reads one character of the class, which can be escaped with a backslash
+	next := func() (rune, error) {
+		if i < len(glob) && glob[i] == '\\' {
+			i++
+		}
+		if i >= len(glob) {
+			return 0, errors.New("unclosed character class")
+		}
+		r, size := utf8.DecodeRuneInString(glob[i:])
+		i += size
+		return r, nil
+	}
+
+	empty := true
+	for {
+		if i >= len(glob) {
+			return "", 0, errors.New("unclosed character class")
+		}
+		if glob[i] == ']' {
+			if empty {
+				return "", 0, errors.New("empty character class")
+			}
+			class.WriteString("]")
+			return class.String(), i + 1, nil
+		}
+
+		lo, err := next()
+		if err != nil {
+			return "", 0, err
+		}
+		class.WriteString(classChar(lo))
+
+		if i+1 < len(glob) && glob[i] == '-' && glob[i+1] != ']' {
+			i++
+			hi, err := next()
+			if err != nil {
+				return "", 0, err
+			}
+			if hi < lo {
+				return "", 0, fmt.Errorf("invalid character class range %c-%c", lo, hi)
+			}
+			class.WriteString("-" + classChar(hi))
+		}
+		empty = false
+	}
+}
+
+// classChar escapes the character for a regular expression character class
+func classChar(r rune) string {
+	if r == '-' {
+		return `\-`
+	}
+	return regexp.QuoteMeta(string(r))
+}
+
+func (ep emailPattern) match(email string) bool {
+	return ep.regex.MatchString(email)
+}
+
+// validity limits when an allowlist entry is in effect, zero times are not limited
+type validity struct {
+	from  time.Time
+	until time.Time
+}
+
+func (v validity) active(now time.Time) bool {
+	return (v.from.IsZero() || !now.Before(v.from)) && (v.until.IsZero() || now.Before(v.until))
+}
+
+func (v validity) limited() bool {
+	return !v.from.IsZero() || !v.until.IsZero()
+}
+
+// within limits the validity to the period of the outer validity as well, e.g. that of a group
+func (v validity) within(outer validity) validity {
+	if v.from.IsZero() || outer.from.After(v.from) {
+		v.from = outer.from
+	}
+	if v.until.IsZero() || (!outer.until.IsZero() && outer.until.Before(v.until)) {
+		v.until = outer.until
+	}
+	return v
+}
+
+// grant is an allowlist entry, with the rule it came from for logging
+type grant struct {
+	rule string
+	// Name of the group the entry is in, if any
+	group string
+	validity
+}
+
+type wildcardGrant struct {
+	suffix string
+	grant
+}
+
+// allowlist decides which normalized emails are allowed to log in
+type allowlist struct {
+	domains   map[string][]grant
+	wildcards []wildcardGrant
+	emails    map[string][]grant
+	allow     []emailPattern
+	deny      []emailPattern
+
+	// Blocked domains and the rules they came from, blocking their subdomains as well
+	blocked map[string]string
+
+	// Validity of the configured groups, for emails invited to them
+	groups map[string]validity
+
+	// The files the entries were read from, to reload them when they change
+	files []string
+}
+
+// newAllowlist compiles the email configuration to an allowlist, without the entries from files
+func newAllowlist(config EmailConfig) (*allowlist, error) {
+	al := &allowlist{
+		domains: map[string][]grant{},
+		emails:  map[string][]grant{},
+		groups:  map[string]validity{},
+		blocked: map[string]string{},
+	}
+
+	for _, domain := range config.ValidDomains {
+		if err := al.addDomain(domain, grant{rule: "valid_domains"}); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, entry := range config.ValidEmails {
+		g := grant{rule: "valid_emails", validity: validity{from: entry.ValidFrom, until: entry.ValidUntil}}
+		if err := al.addEmail(config, entry.Email, g); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, group := range config.Groups {
+		groupValidity := validity{from: group.ValidFrom, until: group.ValidUntil}
+		al.groups[group.Name] = groupValidity
+
+		for _, domain := range group.Domains {
+			if err := al.addDomain(domain, grant{rule: "groups " + group.Name, group: group.Name, validity: groupValidity}); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, entry := range group.Emails {
+			g := grant{rule: "groups " + group.Name, group: group.Name, validity: validity{from: entry.ValidFrom, until: entry.ValidUntil}.within(groupValidity)}
+			if err := al.addEmail(config, entry.Email, g); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, domain := range config.BlockedDomains {
+		if err := al.addBlockedDomain(domain, "blocked_domains"); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, source := range config.AllowPatterns {
+		pattern, err := newEmailPattern(source)
+		if err != nil {
+			return nil, err
+		}
+		al.allow = append(al.allow, pattern)
+	}
+
+	for _, source := range config.DenyPatterns {
+		pattern, err := newEmailPattern(source)
+		if err != nil {
+			return nil, err
+		}
+		al.deny = append(al.deny, pattern)
+	}
+
+	return al, nil
+}
+
+// loadAllowlist compiles the email configuration to an allowlist including the entries from files
+func loadAllowlist(config EmailConfig) (*allowlist, error) {
+	al, err := newAllowlist(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.ValidDomainsFile != "" {
+		addDomain := func(domain string) error {
+			return al.addDomain(domain, grant{rule: "valid_domains_file"})
+		}
+		if err := al.readFile(config.ValidDomainsFile, "domain", addDomain); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ValidEmailsFile != "" {
+		addEmail := func(email string) error {
+			return al.addEmail(config, email, grant{rule: "valid_emails_file"})
+		}
+		if err := al.readFile(config.ValidEmailsFile, "email", addEmail); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.BlockedDomainsFile != "" {
+		addBlockedDomain := func(domain string) error {
+			return al.addBlockedDomain(domain, "blocked_domains_file")
+		}
+		if err := al.readFile(config.BlockedDomainsFile, "domain", addBlockedDomain); err != nil {
+			return nil, err
+		}
+	}
+
+	return al, nil
+}
+
+func (al *allowlist) addDomain(domain string, g grant) error {
+	// *.corp.example allows all the subdomains of corp.example, but not corp.example itself
+	subdomains, wildcard := strings.CutPrefix(domain, "*.")
+
+	normalized, err := normalizeDomain(subdomains)
+	if err != nil {
+		return err
+	}
+
+	if wildcard {
+		g.rule += " " + domain
+		al.wildcards = append(al.wildcards, wildcardGrant{suffix: "." + normalized, grant: g})
+	} else {
+		g.rule += " " + normalized
+		al.domains[normalized] = append(al.domains[normalized], g)
+	}
+	return nil
+}
+
+func (al *allowlist) addBlockedDomain(domain string, rule string) error {
+	normalized, err := normalizeDomain(strings.TrimPrefix(domain, "*."))
+	if err != nil {
+		return err
+	}
+	al.blocked[normalized] = rule + " " + normalized
+	return nil
+}
+
+func (al *allowlist) addEmail(config EmailConfig, email string, g grant) error {
+	normalized, err := normalizeEmail(config, email)
+	if err != nil {
+		return fmt.Errorf("invalid email %s: %w", email, err)
+	}
+	al.emails[normalized] = append(al.emails[normalized], g)
+	return nil
+}
+
+// readFile adds the entries from a plain text file with one entry per line, or a CSV file with the entries in the
+// first column. Empty lines, # comments and a header row are skipped, and malformed lines are logged and ignored.
+func (al *allowlist) readFile(filename string, header string, add func(entry string) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Each line is read on its own so a malformed one, e.g. with a stray quote, can't take the following ones with it
+	scanner := bufio.NewScanner(file)
+	line := 0
+	first := true
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		entry, err := firstColumn(text)
+		if err == nil && first && strings.EqualFold(entry, header) {
+			first = false
+			continue
+		}
+		first = false
+
+		if err == nil && entry != "" {
+			err = add(entry)
+		}
+		if err != nil {
+			slog.Warn("Ignoring malformed allowlist line", slog.String("file", filename), slog.Int("line", line), slog.Any("error", err))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	al.files = append(al.files, filename)
+	return nil
+}
+
+// firstColumn gets the first column of a CSV line, which may be quoted with "" standing for a quote within it
+func firstColumn(line string) (string, error) {
+	quoted, ok := strings.CutPrefix(line, `"`)
+	if !ok {
+		column, _, _ := strings.Cut(line, ",")
+		if strings.Contains(column, `"`) {
+			return "", errors.New("bare quote in unquoted column")
+		}
+		return strings.TrimSpace(column), nil
+	}
+
+	var column strings.Builder
+	for {
+		before, after, found := strings.Cut(quoted, `"`)
+		if !found {
+			return "", errors.New("unterminated quoted column")
+		}
+		column.WriteString(before)
+
+		if rest, escaped := strings.CutPrefix(after, `"`); escaped {
+			column.WriteString(`"`)
+			quoted = rest
+			continue
+		}
+
+		if rest := strings.TrimSpace(after); rest != "" && !strings.HasPrefix(rest, ",") {
+			return "", errors.New("extra text after quoted column")
+		}
+		return strings.TrimSpace(column.String()), nil
+	}
+}
+
+// grants finds the domain and email entries matching the normalized email
+func (al *allowlist) grants(email string) []grant {
+	_, domain, _ := strings.Cut(email, "@")
+
+	var grants []grant
+	grants = append(grants, al.domains[domain]...)
+	for _, wildcard := range al.wildcards {
+		if strings.HasSuffix(domain, wildcard.suffix) {
+			grants = append(grants, wildcard.grant)
+		}
+	}
+	grants = append(grants, al.emails[email]...)
+	return grants
+}
+
+// check decides if the normalized email is allowed to log in at the given time, also giving the rule that
+// decided it
+func (al *allowlist) check(email string, now time.Time) (bool, string) {
+	// Deny rules take precedence so exceptions can be made to allowed domains
+	if denied, rule := al.denied(email); denied {
+		return false, rule
+	}
+
+	for _, g := range al.grants(email) {
+		if g.active(now) {
+			return true, g.rule
+		}
+	}
+
+	for _, pattern := range al.allow {
+		if pattern.match(email) {
+			return true, "allow_patterns " + pattern.source
+		}
+	}
+
+	return false, ""
+}
+
+// groupsOf finds the configured groups the normalized email is in at the given time
+func (al *allowlist) groupsOf(email string, now time.Time) []string {
+	var groups []string
+	for _, g := range al.grants(email) {
+		if g.group != "" && g.active(now) && !slices.Contains(groups, g.group) {
+			groups = append(groups, g.group)
+		}
+	}
+	return groups
+}
+
+// blockedDomain checks if the domain of the normalized email or any of its parent domains is blocked, also giving
+// the rule
+func (al *allowlist) blockedDomain(email string) (bool, string) {
+	_, domain, _ := strings.Cut(email, "@")
+	for {
+		if rule, ok := al.blocked[domain]; ok {
+			return true, rule
+		}
+
+		var found bool
+		_, domain, found = strings.Cut(domain, ".")
+		if !found {
+			return false, ""
+		}
+	}
+}
+
+// denied checks if the normalized email matches any of the blocked domains or deny rules, also giving the rule
+func (al *allowlist) denied(email string) (bool, string) {
+	if blocked, rule := al.blockedDomain(email); blocked {
+		return true, rule
+	}
+
+	for _, pattern := range al.deny {
+		if pattern.match(email) {
+			return true, "deny_patterns " + pattern.source
+		}
+	}
+	return false, ""
+}
+
+// expired checks if the normalized email is not allowed to log in at the given time only because its entries are
+// limited to another time
+func (al *allowlist) expired(email string, now time.Time) bool {
+	if allowed, _ := al.check(email, now); allowed {
+		return false
+	}
+
+	for _, g := range al.grants(email) {
+		if g.limited() {
+			return true
+		}
+	}
+	return false
+}
+
+// emailAllowlist gets the allowlist for the current configuration
+func (s *Server) emailAllowlist() *allowlist {
+	s.allowlistLock.Lock()
+	defer s.allowlistLock.Unlock()
+
+	if s.allowlist == nil {
+		al, err := loadAllowlist(s.Config.Email)
+		if err != nil {
+			// The allowlist is loaded when starting and the configuration is validated on reload
+			panic(err)
+		}
+		s.allowlist = al
+	}
+	return s.allowlist
+}
+
+// watchAllowlist reloads the allowlist in the background when the files it was read from change, replacing the
+// watcher of the previous allowlist
+func (s *Server) watchAllowlist() {
+	s.stopWatchingAllowlist()
+
+	s.allowlistLock.Lock()
+	defer s.allowlistLock.Unlock()
+
+	if s.allowlist == nil || len(s.allowlist.files) == 0 {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Error("Failed to watch allowlist files", slog.Any("error", err))
+		return
+	}
+
+	// The directories are watched as the files are best replaced by renaming new ones over them
+	files := map[string]bool{}
+	for _, filename := range s.allowlist.files {
+		path, err := filepath.Abs(filename)
+		if err == nil {
+			err = watcher.Add(filepath.Dir(path))
+		}
+		if err != nil {
+			slog.Error("Failed to watch allowlist file", slog.String("file", filename), slog.Any("error", err))
+			continue
+		}
+		files[path] = true
+	}
+
+	s.allowlistWatcher = watcher
+	go s.runAllowlistWatcher(watcher, files)
+}
+
+// stopWatchingAllowlist stops reloading the allowlist when its files change
+func (s *Server) stopWatchingAllowlist() {
+	s.allowlistLock.Lock()
+	defer s.allowlistLock.Unlock()
+
+	if s.allowlistWatcher == nil {
+		return
+	}
+	if err := s.allowlistWatcher.Close(); err != nil {
+		slog.Error("Failed to stop watching allowlist files", slog.Any("error", err))
+	}
+	s.allowlistWatcher = nil
+}
+
+// runAllowlistWatcher reloads the allowlist once the changes to its files settle, until the watcher is closed
+func (s *Server) runAllowlistWatcher(watcher *fsnotify.Watcher, files map[string]bool) {
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if files[filepath.Clean(event.Name)] {
+				reload = time.After(allowlistReloadDelay)
+			}
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Error watching allowlist files", slog.Any("error", err))
+
+		case <-reload:
+			reload = nil
+			s.reloadAllowlist()
+		}
+	}
+}
+
+// reloadAllowlist re-reads the allowlist files, a new allowlist replaces the previous one only once it has been fully
+// read and the previous one is kept if the files can't be read
+func (s *Server) reloadAllowlist() {
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	al, err := loadAllowlist(s.Config.Email)
+	if err != nil {
+		slog.Error("Failed to reload allowlist files", slog.Any("error", err))
+		return
+	}
+
+	s.allowlistLock.Lock()
+	s.allowlist = al
+	s.allowlistLock.Unlock()
+	slog.Info("Reloaded allowlist files")
+}
+
+// countBlockedAttempt counts the attempts to log in blocked by the rule since starting, giving the count so far
+func (s *Server) countBlockedAttempt(rule string) int {
+	s.blockedLock.Lock()
+	defer s.blockedLock.Unlock()
+
+	if s.blockedAttempts == nil {
+		s.blockedAttempts = map[string]int{}
+	}
+	s.blockedAttempts[rule]++
+	return s.blockedAttempts[rule]
+}
+
+// emailAllowed checks if the normalized email is allowed to log in by the configuration or the dynamic allowlist
+func emailAllowed(srv *Server, email string) bool {
+	now := time.Now()
+	if allowed, _ := srv.emailAllowlist().check(email, now); allowed {
+		return true
+	}
+
+	grant, err := dynamicAccess(srv, email)
+	if err != nil {
+		slog.Error("Error checking dynamic allowlist", slog.String("email", email), slog.Any("error", err))
+		return false
+	}
+	return grant != nil && grantActive(srv, grant, now)
+}
+
+// checkAccess ensures the token's email is still allowed to log in, so tokens stop working once the entry they were
+// issued through expires or is removed from the configuration or the dynamic allowlist
+func checkAccess(srv *Server, claims *tokenClaims) error {
+	now := time.Now()
+	al := srv.emailAllowlist()
+
+	// The standalone authorization webhook decided who may log in, the allowlist can only deny
+	if srv.Config.AuthzWebhook.Standalone {
+		if denied, rule := al.denied(claims.Subject); denied {
+			return fmt.Errorf("%s is denied by %s", claims.Subject, rule)
+		}
+		return nil
+	}
+
+	if allowed, _ := al.check(claims.Subject, now); allowed {
+		return nil
+	}
+
+	grant, err := dynamicAccess(srv, claims.Subject)
+	if err != nil {
+		return err
+	}
+	if grant != nil && grantActive(srv, grant, now) {
+		return nil
+	}
+
+	if grant != nil || al.expired(claims.Subject, now) {
+		return fmt.Errorf("%w: access for %s has expired", jwt.ErrTokenExpired, claims.Subject)
+	}
+	return fmt.Errorf("%s is no longer allowed to log in", claims.Subject)
+}
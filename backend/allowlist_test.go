@@ -0,0 +1,198 @@
+package backend
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowlistFiles(t *testing.T) {
+	dir := t.TempDir()
+	domainsFile := filepath.Join(dir, "domains.txt")
+	emailsFile := filepath.Join(dir, "emails.csv")
+
+	domains := "# Managed by HR\nexample.com\n\n*.corp.example\n-invalid-.example\n"
+	emails := "email,name\nalice@partner.example,Alice\n\"bob@partner.example\",\"Bob, Jr.\"\nnot an email,Broken\n" +
+		"\"unterminated,Quote\ncarol@partner.example\nst\"ray@partner.example\n  \"erin@partner.example\" ,Erin\r\n"
+	if err := os.WriteFile(domainsFile, []byte(domains), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(emailsFile, []byte(emails), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Config: Config{Email: EmailConfig{
+		ValidDomainsFile: domainsFile,
+		ValidEmailsFile:  emailsFile,
+	}}}
+
+	// Malformed lines don't affect the lines after them
+	for _, email := range []string{"user@example.com", "user@eu.corp.example", "alice@partner.example", "bob@partner.example", "carol@partner.example", "erin@partner.example"} {
+		if !emailAllowed(srv, email) {
+			t.Errorf("Email %s from the files was not allowed", email)
+		}
+	}
+	for _, email := range []string{"user@corp.example", "dave@partner.example", "email@partner.example", "st\"ray@partner.example"} {
+		if emailAllowed(srv, email) {
+			t.Errorf("Email %s was allowed", email)
+		}
+	}
+
+	// Changes are picked up in the background
+	srv.watchAllowlist()
+	defer srv.stopWatchingAllowlist()
+
+	if err := os.WriteFile(emailsFile+".new", []byte("dave@partner.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(emailsFile+".new", emailsFile); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !emailAllowed(srv, "dave@partner.example") && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !emailAllowed(srv, "dave@partner.example") || emailAllowed(srv, "alice@partner.example") {
+		t.Error("Allowlist was not reloaded after the file changed")
+	}
+
+	// The previous allowlist is kept if the file can't be read
+	if err := os.Remove(emailsFile); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(4 * allowlistReloadDelay)
+	if !emailAllowed(srv, "dave@partner.example") {
+		t.Error("Allowlist was lost when the file was removed")
+	}
+
+	if _, err := loadAllowlist(srv.Config.Email); err == nil {
+		t.Error("Loading a missing allowlist file did not fail")
+	}
+}
+
+func TestAllowlistValidity(t *testing.T) {
+	now := time.Now()
+	al, err := newAllowlist(EmailConfig{
+		ValidDomains: []string{"example.com"},
+		ValidEmails: []EmailEntry{
+			{Email: "auditor@audit.example", ValidFrom: now.Add(-time.Hour), ValidUntil: now.Add(time.Hour)},
+			{Email: "user@example.com", ValidUntil: now.Add(-time.Hour)},
+		},
+		Groups: []EmailGroupConfig{{
+			Name:       "auditors",
+			Domains:    []string{"*.audit.example"},
+			Emails:     []EmailEntry{{Email: "late@audit.example", ValidUntil: now.Add(2 * time.Hour)}},
+			ValidFrom:  now.Add(-time.Hour),
+			ValidUntil: now.Add(time.Hour),
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		email   string
+		at      time.Time
+		allowed bool
+		expired bool
+	}{
+		{"auditor@audit.example", now, true, false},
+		{"auditor@audit.example", now.Add(-2 * time.Hour), false, true},
+		{"auditor@audit.example", now.Add(2 * time.Hour), false, true},
+		{"user@eu.audit.example", now, true, false},
+		{"user@eu.audit.example", now.Add(2 * time.Hour), false, true},
+		{"late@audit.example", now.Add(90 * time.Minute), false, true},
+		// Also allowed by the domain without a time limit
+		{"user@example.com", now, true, false},
+		{"other@audit.example", now, false, false},
+	}
+
+	for _, test := range tests {
+		allowed, _ := al.check(test.email, test.at)
+		if allowed != test.allowed {
+			t.Errorf("%s allowed at %s: %v, expected %v", test.email, test.at, allowed, test.allowed)
+		}
+		if expired := al.expired(test.email, test.at); expired != test.expired {
+			t.Errorf("%s expired at %s: %v, expected %v", test.email, test.at, expired, test.expired)
+		}
+	}
+
+	invalid := EmailConfig{ValidEmails: []EmailEntry{{Email: "user@example.com", ValidFrom: now, ValidUntil: now}}}
+	if err := checkEmailConfig(invalid); err == nil {
+		t.Error("Entry with valid_until before valid_from passed")
+	}
+}
+
+func TestAllowlistBlockedDomains(t *testing.T) {
+	blockedFile := filepath.Join(t.TempDir(), "blocked.txt")
+	if err := os.WriteFile(blockedFile, []byte("# Throwaway providers\nmailinator.example\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	al, err := loadAllowlist(EmailConfig{
+		ValidDomains:       []string{"uni.example", "*.uni.example", "mailinator.example"},
+		BlockedDomains:     []string{"students.uni.example"},
+		BlockedDomainsFile: blockedFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		email   string
+		blocked string
+	}{
+		{"prof@uni.example", ""},
+		{"prof@cs.uni.example", ""},
+		{"student@students.uni.example", "blocked_domains students.uni.example"},
+		{"student@cs.students.uni.example", "blocked_domains students.uni.example"},
+		{"user@mailinator.example", "blocked_domains_file mailinator.example"},
+	}
+
+	for _, test := range tests {
+		blocked, rule := al.blockedDomain(test.email)
+		if blocked != (test.blocked != "") || rule != test.blocked {
+			t.Errorf("blockedDomain(%s) = %v %q, expected %q", test.email, blocked, rule, test.blocked)
+		}
+
+		if allowed, _ := al.check(test.email, time.Now()); allowed != (test.blocked == "") {
+			t.Errorf("check(%s) = %v", test.email, allowed)
+		}
+	}
+}
+
+func TestEmailPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		email   string
+		match   bool
+	}{
+		{"ops-[0-9]@example.com", "ops-1@example.com", true},
+		{"ops-[0-9]@example.com", "ops-a@example.com", false},
+		{"ops-[^0-9]@example.com", "ops-a@example.com", true},
+		{"ops[\\-_]?@example.com", "ops-1@example.com", true},
+		{"ops[\\-_]?@example.com", "opsb1@example.com", false},
+		{"[a-c\\]]*@example.com", "]x@example.com", true},
+		// Emails are matched in lowercase, so regular expressions ignore case
+		{"/^Ops-.*@example\\.com$/", "ops-team@example.com", true},
+		{"Ops-*@Example.com", "ops-team@example.com", true},
+	}
+
+	for _, test := range tests {
+		pattern, err := newEmailPattern(test.pattern)
+		if err != nil {
+			t.Errorf("Pattern %s failed: %s", test.pattern, err)
+			continue
+		}
+		if match := pattern.match(test.email); match != test.match {
+			t.Errorf("Pattern %s matching %s: %v, expected %v", test.pattern, test.email, match, test.match)
+		}
+	}
+
+	if _, err := newEmailPattern("[z-a]@example.com"); err == nil || !strings.Contains(err.Error(), "range z-a") {
+		t.Errorf("Invalid character class gave error %v, expected one about the range", err)
+	}
+}
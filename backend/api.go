@@ -1,16 +1,107 @@
 package backend
 
+import "time"
+
 type emailVerifyRequest struct {
-	Email string `json:"email" validate:"required,email"`
-	Code  string `json:"code" validate:"required,len=8"`
+	Email  string `json:"email" validate:"required,email"`
+	Code   string `json:"code" validate:"required,max=64"`
+	Target string `json:"target" validate:"omitempty,url,max=4096"`
 }
 
 type emailSendRequest struct {
-	Email string `json:"email" validate:"required,email"`
+	Email  string `json:"email" validate:"required,email"`
+	Target string `json:"target" validate:"omitempty,url,max=4096"`
+}
+
+type accessRequestRequest struct {
+	Email  string `json:"email" validate:"required,email"`
+	Reason string `json:"reason" validate:"required,max=1000"`
+}
+
+type accessDecideRequest struct {
+	Token string `json:"token" validate:"required,max=4096"`
 }
 
 type configResponse struct {
-	Title   string `json:"title"`
-	Brand   string `json:"brand"`
-	Support string `json:"support"`
+	Title    string             `json:"title"`
+	Brand    string             `json:"brand"`
+	Support  string             `json:"support"`
+	Sessions bool               `json:"sessions"`
+	Code     codeFormatResponse `json:"code"`
+
+	AccessRequests bool `json:"access_requests"`
+}
+
+type codeFormatResponse struct {
+	Alphabet string `json:"alphabet"`
+	Length   int    `json:"length"`
+}
+
+type sessionResponse struct {
+	ID        string    `json:"id"`
+	IssuedAt  time.Time `json:"issued_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Current   bool      `json:"current"`
+}
+
+type sessionsResponse struct {
+	Email    string            `json:"email"`
+	Sessions []sessionResponse `json:"sessions"`
+}
+
+type accessDecisionResponse struct {
+	Email      string     `json:"email"`
+	Reason     string     `json:"reason"`
+	Created    time.Time  `json:"created"`
+	Approve    bool       `json:"approve"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+type accessGrantResponse struct {
+	Email      string    `json:"email"`
+	GrantedBy  string    `json:"granted_by"`
+	Reason     string    `json:"reason"`
+	Granted    time.Time `json:"granted"`
+	ValidUntil time.Time `json:"valid_until"`
+	Groups     []string  `json:"groups,omitempty"`
+	Active     bool      `json:"active"`
+}
+
+type adminInvitationRequest struct {
+	Email      string   `json:"email" validate:"required,email"`
+	Groups     []string `json:"groups" validate:"dive,min=1"`
+	ValidDays  int      `json:"valid_days" validate:"gte=0,lte=365"`
+	AccessDays int      `json:"access_days" validate:"gte=0"`
+	Send       bool     `json:"send"`
+}
+
+type adminInvitationResponse struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+type invitationRequest struct {
+	Token string `json:"token" validate:"required,max=4096"`
+}
+
+type invitationResponse struct {
+	Email      string     `json:"email"`
+	Groups     []string   `json:"groups,omitempty"`
+	ValidUntil *time.Time `json:"valid_until,omitempty"`
+}
+
+type adminDebugRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+type adminDebugResponse struct {
+	Enabled bool `json:"enabled"`
+	DevMode bool `json:"dev_mode"`
+}
+
+type jwksResponse struct {
+	Keys []jwk `json:"keys"`
 }
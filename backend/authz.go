@@ -0,0 +1,195 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Maximum number of decisions of the authorization webhook cached at a time
+const authzCacheSize = 10000
+
+// authzRequest is sent to the authorization webhook
+type authzRequest struct {
+	Email string `json:"email"`
+	Host  string `json:"host"`
+	Path  string `json:"path"`
+}
+
+// authzDecision is the answer of the authorization webhook
+type authzDecision struct {
+	Allow  bool     `json:"allow"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+type cachedAuthzDecision struct {
+	decision authzDecision
+	expires  time.Time
+}
+
+// authzWebhook asks an external service who is allowed to log in, caching the decisions
+type authzWebhook struct {
+	config AuthzWebhookConfig
+	client *http.Client
+
+	lock      sync.Mutex
+	cache     map[authzRequest]cachedAuthzDecision
+	nextPrune time.Time
+}
+
+func newAuthzWebhook(config AuthzWebhookConfig) *authzWebhook {
+	return &authzWebhook{
+		config: config,
+		client: &http.Client{Timeout: time.Duration(config.TimeoutSeconds) * time.Second},
+		cache:  map[authzRequest]cachedAuthzDecision{},
+	}
+}
+
+// cached finds a decision made for the same email, host and path that has not expired yet
+func (aw *authzWebhook) cached(request authzRequest, now time.Time) (authzDecision, bool) {
+	aw.lock.Lock()
+	defer aw.lock.Unlock()
+
+	entry, ok := aw.cache[request]
+	if !ok || !now.Before(entry.expires) {
+		return authzDecision{}, false
+	}
+	return entry.decision, true
+}
+
+// store caches the decision, pruning the expired decisions now and then, and dropping some of the others if the
+// cache is still full. The size limit keeps e.g. clients scanning for paths from growing the cache without limit.
+func (aw *authzWebhook) store(request authzRequest, decision authzDecision, now time.Time) {
+	if aw.config.CacheSeconds == 0 {
+		return
+	}
+
+	aw.lock.Lock()
+	defer aw.lock.Unlock()
+
+	_, exists := aw.cache[request]
+	full := !exists && len(aw.cache) >= authzCacheSize
+
+	ttl := time.Duration(aw.config.CacheSeconds) * time.Second
+	if full || now.After(aw.nextPrune) {
+		for key, entry := range aw.cache {
+			if !now.Before(entry.expires) {
+				delete(aw.cache, key)
+			}
+		}
+		aw.nextPrune = now.Add(ttl)
+	}
+
+	// Map iteration order is random, so this drops arbitrary decisions that will be asked for again when needed
+	for key := range aw.cache {
+		if exists || len(aw.cache) < authzCacheSize {
+			break
+		}
+		delete(aw.cache, key)
+	}
+
+	aw.cache[request] = cachedAuthzDecision{decision: decision, expires: now.Add(ttl)}
+}
+
+// call asks the webhook for a decision
+func (aw *authzWebhook) call(ctx context.Context, request authzRequest) (authzDecision, error) {
+	decision := authzDecision{}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return decision, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", aw.config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return decision, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := aw.client.Do(req)
+	if err != nil {
+		return decision, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return decision, fmt.Errorf("authorization webhook returned status %d", resp.StatusCode)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&decision)
+	return decision, err
+}
+
+// authorize gets the decision for the request, from the cache if possible. Failures are not cached and are allowed
+// or denied per fail_open.
+func (aw *authzWebhook) authorize(ctx context.Context, request authzRequest) authzDecision {
+	now := time.Now()
+	if decision, ok := aw.cached(request, now); ok {
+		return decision
+	}
+
+	decision, err := aw.call(ctx, request)
+	if err != nil {
+		slog.ErrorContext(ctx, "Authorization webhook failed", slog.Bool("fail_open", aw.config.FailOpen), slog.Any("error", err))
+		authzWebhookResults.WithLabelValues("error").Inc()
+		return authzDecision{Allow: aw.config.FailOpen}
+	}
+
+	if decision.Allow {
+		authzWebhookResults.WithLabelValues("allow").Inc()
+	} else {
+		authzWebhookResults.WithLabelValues("deny").Inc()
+	}
+	aw.store(request, decision, now)
+	return decision
+}
+
+// authzWebhook gets the authorization webhook for the current configuration, nil if it is not configured
+func (s *Server) authzWebhook() *authzWebhook {
+	s.authzLock.Lock()
+	defer s.authzLock.Unlock()
+
+	if s.Config.AuthzWebhook.URL == "" {
+		return nil
+	}
+
+	if s.authz == nil {
+		s.authz = newAuthzWebhook(s.Config.AuthzWebhook)
+	}
+	return s.authz
+}
+
+// authorized asks the authorization webhook if the email may log in, everyone is if it is not configured
+func authorized(ctx context.Context, srv *Server, request authzRequest) authzDecision {
+	webhook := srv.authzWebhook()
+	if webhook == nil {
+		return authzDecision{Allow: true}
+	}
+	return webhook.authorize(ctx, request)
+}
+
+// mayLogIn checks if the normalized email may log in to the target, by the allowlists and the authorization webhook
+// having the final say, or the webhook alone if it's standalone. Every way of getting or using a code goes through
+// here.
+func mayLogIn(ctx context.Context, srv *Server, email string, target string) bool {
+	if srv.Config.AuthzWebhook.Standalone {
+		if denied, _ := srv.emailAllowlist().denied(email); denied {
+			return false
+		}
+	} else if !emailAllowed(srv, email) {
+		return false
+	}
+
+	request := authzRequest{Email: email}
+	if u, err := url.Parse(target); err == nil {
+		request.Host = u.Host
+		request.Path = u.Path
+	}
+	return authorized(ctx, srv, request).Allow
+}
@@ -0,0 +1,95 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/netip"
+)
+
+// clientBinding ties a token to characteristics of the client it was issued to, so a stolen cookie does not work
+// from elsewhere. The values are keyed hashes as the token contents are readable.
+type clientBinding struct {
+	ipHash string
+	uaHash string
+}
+
+// bindingHash gives a keyed hash of a client characteristic
+func bindingHash(key *ringKey, kind string, value string) string {
+	hash := getHash(hex.EncodeToString(deriveKey(key.secret, "binding")), kind+" | "+value)
+	return hex.EncodeToString(hash[:sha256.Size/2])
+}
+
+// clientPrefix gets the network of the client IP with the configured prefix length, so changing addresses within
+// e.g. the same office network or IPv6 privacy addresses don't break the binding
+func clientPrefix(config TokenBindingConfig, ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ip
+	}
+	addr = addr.Unmap()
+
+	bits := config.IPv6Prefix
+	if addr.Is4() {
+		bits = config.IPv4Prefix
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ip
+	}
+	return prefix.String()
+}
+
+// newClientBinding binds a new session to the client making the request, if enabled
+func newClientBinding(srv *Server, r *http.Request) clientBinding {
+	config := srv.Config.JWT.Binding
+	key := srv.signingKeys().active
+
+	binding := clientBinding{}
+	if config.IP {
+		binding.ipHash = bindingHash(key, "ip", clientPrefix(config, clientIP(r)))
+	}
+	if config.UserAgent {
+		binding.uaHash = bindingHash(key, "user_agent", r.UserAgent())
+	}
+	return binding
+}
+
+// matchesBinding checks the value against the hash made with any of the keys still in use
+func matchesBinding(srv *Server, hash string, kind string, value string) bool {
+	for _, key := range srv.signingKeys().verificationKeys() {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(bindingHash(key, kind, value))) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClientBinding rejects tokens used from a different client than they were issued to
+func checkClientBinding(srv *Server, r *http.Request, claims *tokenClaims) error {
+	config := srv.Config.JWT.Binding
+	ip := clientIP(r)
+
+	var mismatch string
+	if config.IP && (claims.IPHash == "" || !matchesBinding(srv, claims.IPHash, "ip", clientPrefix(config, ip))) {
+		mismatch = "ip"
+	} else if config.UserAgent && (claims.UserAgentHash == "" || !matchesBinding(srv, claims.UserAgentHash, "user_agent", r.UserAgent())) {
+		mismatch = "user_agent"
+	}
+
+	if mismatch == "" {
+		return nil
+	}
+
+	slog.WarnContext(r.Context(), "Token used from a different client than it was issued to",
+		slog.String("mismatch", mismatch),
+		slog.String("jti", claims.ID),
+		slog.String("client_ip", ip),
+		slog.String("user_agent", r.UserAgent()),
+	)
+	return errors.New("token binding mismatch: " + mismatch)
+}
@@ -0,0 +1,21 @@
+package backend
+
+import "testing"
+
+func TestClientPrefix(t *testing.T) {
+	config := TokenBindingConfig{IP: true, IPv4Prefix: 24, IPv6Prefix: 64}
+
+	tests := map[string]string{
+		"192.0.2.10":              "192.0.2.0/24",
+		"::ffff:192.0.2.10":       "192.0.2.0/24",
+		"2001:db8:1:2:3:4:5:6":    "2001:db8:1:2::/64",
+		"not an ip":               "not an ip",
+		"2001:db8:1:2::abcd:1234": "2001:db8:1:2::/64",
+	}
+
+	for ip, expected := range tests {
+		if prefix := clientPrefix(config, ip); prefix != expected {
+			t.Errorf("Got prefix %s for %s, expected %s", prefix, ip, expected)
+		}
+	}
+}
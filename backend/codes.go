@@ -0,0 +1,175 @@
+package backend
+
+import (
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// How many unused codes are kept per email, requesting more replaces the oldest
+const maxIssuedCodes = 5
+
+// issuedCode is a single-use code sent to an email, only a keyed hash of the code is kept
+type issuedCode struct {
+	Hash    string    `json:"hash"`
+	Expires time.Time `json:"expires"`
+}
+
+// codeStore keeps the issued verification codes in the single-use code mode
+type codeStore interface {
+	// addCode records a code sent to the email
+	addCode(email string, hash string, expires time.Time) error
+	// useCode removes the code if it was issued to the email, reporting if it was valid
+	useCode(email string, hash string) (bool, error)
+}
+
+// addIssuedCode adds the code to the list, dropping expired and the oldest codes over the limit
+func addIssuedCode(codes []issuedCode, code issuedCode, now time.Time) []issuedCode {
+	var kept []issuedCode
+	for _, c := range codes {
+		if !now.After(c.Expires) {
+			kept = append(kept, c)
+		}
+	}
+
+	kept = append(kept, code)
+	if len(kept) > maxIssuedCodes {
+		kept = kept[len(kept)-maxIssuedCodes:]
+	}
+	return kept
+}
+
+// codesExpired checks if all the codes have expired
+func codesExpired(codes []issuedCode, now time.Time) bool {
+	for _, c := range codes {
+		if !now.After(c.Expires) {
+			return false
+		}
+	}
+	return true
+}
+
+// useIssuedCode removes the matching code from the list if it has not expired
+func useIssuedCode(codes []issuedCode, hash string, now time.Time) ([]issuedCode, bool) {
+	for i, c := range codes {
+		if subtle.ConstantTimeCompare([]byte(c.Hash), []byte(hash)) == 1 {
+			remaining := append(codes[:i:i], codes[i+1:]...)
+			return remaining, !now.After(c.Expires)
+		}
+	}
+	return codes, false
+}
+
+func (ms *memorySessionStore) addCode(email string, hash string, expires time.Time) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.codes[email] = addIssuedCode(ms.codes[email], issuedCode{Hash: hash, Expires: expires}, time.Now())
+	return nil
+}
+
+func (ms *memorySessionStore) useCode(email string, hash string) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	codes, ok := useIssuedCode(ms.codes[email], hash, time.Now())
+	if len(codes) == 0 {
+		delete(ms.codes, email)
+	} else {
+		ms.codes[email] = codes
+	}
+	return ok, nil
+}
+
+var codesBucket = []byte("codes")
+
+// updateCodes changes the codes of the email in a single transaction
+func (fs *fileSessionStore) updateCodes(email string, update func(codes []issuedCode) []issuedCode) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(codesBucket)
+
+		var codes []issuedCode
+		if value := bucket.Get([]byte(email)); value != nil {
+			if err := json.Unmarshal(value, &codes); err != nil {
+				return err
+			}
+		}
+
+		codes = update(codes)
+		if len(codes) == 0 {
+			return bucket.Delete([]byte(email))
+		}
+
+		value, err := json.Marshal(codes)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(email), value)
+	})
+}
+
+func (fs *fileSessionStore) addCode(email string, hash string, expires time.Time) error {
+	return fs.updateCodes(email, func(codes []issuedCode) []issuedCode {
+		return addIssuedCode(codes, issuedCode{Hash: hash, Expires: expires}, time.Now())
+	})
+}
+
+func (fs *fileSessionStore) useCode(email string, hash string) (bool, error) {
+	used := false
+	err := fs.updateCodes(email, func(codes []issuedCode) []issuedCode {
+		codes, used = useIssuedCode(codes, hash, time.Now())
+		return codes
+	})
+	return used, err
+}
+
+// codeHash gives the keyed hash of the code stored for single-use codes
+func codeHash(key *ringKey, email string, code string) string {
+	return hex.EncodeToString(getHash(key.codeKey, "single-use | "+email+" | "+code))
+}
+
+// codeFormat gets the configured verification code format
+func (s *Server) codeFormat() codeFormat {
+	return newCodeFormat(s.Config.Auth.Code)
+}
+
+// issueCode makes a new code for the email, recorded on the server in the single-use code mode
+func issueCode(srv *Server, email string) (string, error) {
+	key := srv.signingKeys().active
+	format := srv.codeFormat()
+	if !srv.Config.Auth.SingleUseCodes {
+		return format.make(key.codeKey, email, time.Now()), nil
+	}
+
+	code, err := format.random()
+	if err != nil {
+		return "", err
+	}
+
+	// Valid for as long as the stateless codes at most
+	expires := time.Now().Add(format.validity())
+	if err := srv.sessionStorage().addCode(email, codeHash(key, email, code), expires); err != nil {
+		return "", err
+	}
+	return code, nil
+}
+
+// checkCode checks the code for the email, in the single-use code mode it can't be used again afterwards
+func checkCode(srv *Server, code string, email string) (bool, error) {
+	if !srv.Config.Auth.SingleUseCodes {
+		return checkVerifyCodeAnyKey(srv, code, email), nil
+	}
+
+	// The code could have been issued with a key that has since been rotated
+	code = srv.codeFormat().normalize(code)
+	for _, key := range srv.signingKeys().verificationKeys() {
+		used, err := srv.sessionStorage().useCode(email, codeHash(key, email, code))
+		if err != nil || used {
+			return used, err
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,53 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIssuedCodes(t *testing.T) {
+	now := time.Now()
+
+	var codes []issuedCode
+	codes = addIssuedCode(codes, issuedCode{Hash: "expired", Expires: now.Add(-time.Minute)}, now)
+	for _, hash := range []string{"a", "b", "c", "d", "e", "f"} {
+		codes = addIssuedCode(codes, issuedCode{Hash: hash, Expires: now.Add(time.Minute)}, now)
+	}
+
+	if len(codes) != maxIssuedCodes || codes[0].Hash != "b" {
+		t.Errorf("Expected the oldest codes to be dropped, got %v", codes)
+	}
+
+	codes, ok := useIssuedCode(codes, "c", now)
+	if !ok || len(codes) != maxIssuedCodes-1 {
+		t.Errorf("Using code c returned %v, %v", codes, ok)
+	}
+
+	if _, ok := useIssuedCode(codes, "c", now); ok {
+		t.Error("Code c could be used twice")
+	}
+
+	if _, ok := useIssuedCode(codes, "b", now.Add(2*time.Minute)); ok {
+		t.Error("Expired code b could be used")
+	}
+
+	if !codesExpired(codes, now.Add(2*time.Minute)) || codesExpired(codes, now) {
+		t.Error("Codes expiry not detected correctly")
+	}
+}
+
+func TestRandomCode(t *testing.T) {
+	code, err := defaultCodeFormat.random()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !defaultCodeFormat.valid(code) {
+		t.Errorf("Got code %s not matching the format", code)
+	}
+
+	other, _ := defaultCodeFormat.random()
+	if other == code {
+		t.Errorf("Got the same random code %s twice", code)
+	}
+}
@@ -2,10 +2,13 @@ package backend
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"log/slog"
 	"os"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/goccy/go-yaml"
@@ -18,12 +21,31 @@ type CookieAuthConfig struct {
 	Secure     bool   `yaml:"secure" validate:""`
 }
 
+// TLSConfig contains the certificate configuration for the https listen type
+type TLSConfig struct {
+	CertFile     string `yaml:"cert_file" validate:"max=4096"`
+	KeyFile      string `yaml:"key_file" validate:"max=4096"`
+	ClientCAFile string `yaml:"client_ca_file" validate:"max=4096"`
+}
+
+// ListenerConfig describes one of multiple addresses the server listens to
+type ListenerConfig struct {
+	Type    string    `yaml:"type" validate:"required,oneof=unix http https"`
+	Address string    `yaml:"address" validate:"required,min=1,max=255"`
+	TLS     TLSConfig `yaml:"tls"`
+	Routes  []string  `yaml:"routes" validate:"dive,oneof=login verify metrics admin"`
+}
+
 // ServerConfig contains configuration for the HTTP server
 type ServerConfig struct {
-	ListenType string `yaml:"listen_type" validate:"required,oneof=unix http"`
-	Socket     string `yaml:"socket" validate:"min=1,max=255"`
-	Host       string `yaml:"host" validate:"min=1,max=255"`
-	Port       int    `yaml:"port" validate:"gte=1,lte=65535"`
+	ListenType string           `yaml:"listen_type" validate:"required,oneof=unix http https"`
+	Socket     string           `yaml:"socket" validate:"min=1,max=255"`
+	Host       string           `yaml:"host" validate:"min=1,max=255"`
+	Port       int              `yaml:"port" validate:"gte=1,lte=65535"`
+	TLS        TLSConfig        `yaml:"tls"`
+	Listeners  []ListenerConfig `yaml:"listeners" validate:"dive"`
+	// Addresses of the proxies, e.g. Nginx, allowed to tell the client address in X-Real-IP
+	TrustedProxies []string `yaml:"trusted_proxies" validate:"dive,cidr|ip"`
 }
 
 // RateLimitConfigItem contains details for rate limiting
@@ -39,22 +61,111 @@ type RateLimitConfig struct {
 
 // JWTConfig configures the authentication token properties
 type JWTConfig struct {
-	ValidSeconds int `yaml:"valid_seconds" validate:"required,gte=1,lte=1576800000"`
+	ValidSeconds   int    `yaml:"valid_seconds" validate:"required,gte=1,lte=1576800000"`
+	Algorithm      string `yaml:"algorithm" validate:"omitempty,oneof=HS256 EdDSA ES256 RS256"`
+	PrivateKeyFile string `yaml:"private_key_file" validate:"max=4096"`
+	Issuer         string `yaml:"issuer" validate:"max=255"`
+	LeewaySeconds  int    `yaml:"leeway_seconds" validate:"gte=0,lte=3600"`
+	Encrypt        bool   `yaml:"encrypt"`
+	// Accept HS256 tokens without a kid header from before key rotation support, signed directly with a secret
+	AcceptLegacyTokens bool `yaml:"accept_legacy_tokens"`
+
+	// Sliding sessions, refreshing tokens on use once they are old enough up to the maximum session length
+	RefreshAfterSeconds int `yaml:"refresh_after_seconds" validate:"gte=0,lte=1576800000"`
+	MaxSessionSeconds   int `yaml:"max_session_seconds" validate:"gte=0,lte=1576800000"`
+
+	Binding TokenBindingConfig `yaml:"binding"`
+}
+
+// TokenBindingConfig configures binding tokens to the client they were issued to
+type TokenBindingConfig struct {
+	IP         bool `yaml:"ip"`
+	IPv4Prefix int  `yaml:"ipv4_prefix" validate:"gte=0,lte=32"`
+	IPv6Prefix int  `yaml:"ipv6_prefix" validate:"gte=0,lte=128"`
+	UserAgent  bool `yaml:"user_agent"`
+}
+
+// SessionsConfig configures tracking of login sessions on the server
+type SessionsConfig struct {
+	Store                string `yaml:"store" validate:"oneof=memory file"`
+	Path                 string `yaml:"path" validate:"required_if=Store file,max=4096"`
+	Registry             bool   `yaml:"registry"`
+	IdleTimeoutSeconds   int    `yaml:"idle_timeout_seconds" validate:"gte=0,lte=1576800000"`
+	TouchIntervalSeconds int    `yaml:"touch_interval_seconds" validate:"gte=0,lte=3600"`
+}
+
+// SiteConfig describes a site protected by Praga, tokens are only accepted for the sites they were issued for
+type SiteConfig struct {
+	Host     string `yaml:"host" validate:"required,min=1,max=255"`
+	Audience string `yaml:"audience" validate:"max=255"`
+}
+
+// CodeConfig configures the format and validity of the verification codes
+type CodeConfig struct {
+	Alphabet      string `yaml:"alphabet" validate:"omitempty,min=2,max=64"`
+	Length        int    `yaml:"length" validate:"omitempty,gte=4,lte=32"`
+	WindowMinutes int    `yaml:"window_minutes" validate:"omitempty,gte=1,lte=1440"`
+	ValidWindows  int    `yaml:"valid_windows" validate:"omitempty,gte=2,lte=10"`
 }
 
 // AuthConfig changes how authentication works
 type AuthConfig struct {
-	Mode      string          `yaml:"mode" validate:"required,oneof=email"`
-	RateLimit RateLimitConfig `yaml:"rate_limit"`
+	Mode           string          `yaml:"mode" validate:"required,oneof=email"`
+	RateLimit      RateLimitConfig `yaml:"rate_limit"`
+	SingleUseCodes bool            `yaml:"single_use_codes"`
+	Code           CodeConfig      `yaml:"code"`
+}
+
+// EmailNormalizationConfig configures which variations of addresses at a domain lead to the same mailbox
+type EmailNormalizationConfig struct {
+	Domain    string `yaml:"domain" validate:"required,min=1,max=255"`
+	StripPlus bool   `yaml:"strip_plus"`
+	StripDots bool   `yaml:"strip_dots"`
+}
+
+// EmailEntry is an email allowed to log in, optionally only for a limited time. It can be given as just the
+// address in the configuration.
+type EmailEntry struct {
+	Email      string    `yaml:"email" validate:"required,email"`
+	ValidFrom  time.Time `yaml:"valid_from"`
+	ValidUntil time.Time `yaml:"valid_until"`
+}
+
+func (e *EmailEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var email string
+	if err := unmarshal(&email); err == nil {
+		e.Email = email
+		return nil
+	}
+
+	type plain EmailEntry
+	return unmarshal((*plain)(e))
+}
+
+// EmailGroupConfig allows a named group of domains and emails to log in, optionally only for a limited time
+type EmailGroupConfig struct {
+	Name       string       `yaml:"name" validate:"required,min=1"`
+	Domains    []string     `yaml:"domains" validate:"dive,min=1,max=255"`
+	Emails     []EmailEntry `yaml:"emails" validate:"dive"`
+	ValidFrom  time.Time    `yaml:"valid_from"`
+	ValidUntil time.Time    `yaml:"valid_until"`
 }
 
 // EmailConfig configures email related settings
 type EmailConfig struct {
-	ValidDomains  []string `yaml:"valid_domains" validate:"dive,min=1,max=255"`
-	ValidEmails   []string `yaml:"valid_emails" validate:"dive,email"`
-	EmailProvider string   `yaml:"email_provider" validate:"required,oneof=mailjet"`
-	From          string   `yaml:"from" validate:"required,email"`
-	FromName      string   `yaml:"from_name" validate:"required,min=1"`
+	ValidDomains       []string                   `yaml:"valid_domains" validate:"dive,min=1,max=255"`
+	ValidEmails        []EmailEntry               `yaml:"valid_emails" validate:"dive"`
+	ValidDomainsFile   string                     `yaml:"valid_domains_file"`
+	ValidEmailsFile    string                     `yaml:"valid_emails_file"`
+	Groups             []EmailGroupConfig         `yaml:"groups" validate:"dive"`
+	AllowPatterns      []string                   `yaml:"allow_patterns" validate:"dive,min=1"`
+	DenyPatterns       []string                   `yaml:"deny_patterns" validate:"dive,min=1"`
+	BlockedDomains     []string                   `yaml:"blocked_domains" validate:"dive,min=1,max=255"`
+	BlockedDomainsFile string                     `yaml:"blocked_domains_file"`
+	Normalize          []EmailNormalizationConfig `yaml:"normalize" validate:"dive"`
+	EmailProvider      string                     `yaml:"email_provider" validate:"required,oneof=mailjet"`
+	From               string                     `yaml:"from" validate:"required,email"`
+	FromName           string                     `yaml:"from_name" validate:"required,min=1"`
 }
 
 // MailjetConfig provides Mailjet API configuration
@@ -63,22 +174,110 @@ type MailjetConfig struct {
 	APIKeyPrivate string `yaml:"apikey_private" validate:"min=0,max=255"`
 }
 
+// MetricsConfig configures the Prometheus metrics endpoint
+type MetricsConfig struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// AuditConfig configures the audit log of security events
+type AuditConfig struct {
+	Path       string `yaml:"path" validate:"max=4096"`
+	HashEmails bool   `yaml:"hash_emails"`
+	// Kept apart from the signing keys so the hashes stay the same when they are rotated
+	HashKey string `yaml:"hash_key" validate:"omitempty,min=16,max=255"`
+}
+
+// LogConfig configures logging
+type LogConfig struct {
+	Level  string      `yaml:"level" validate:"oneof=debug info warn error"`
+	Format string      `yaml:"format" validate:"oneof=text json"`
+	Audit  AuditConfig `yaml:"audit"`
+}
+
+// AdminConfig configures access to the admin API
+type AdminConfig struct {
+	Token string `yaml:"token" validate:"omitempty,min=16,max=255"`
+}
+
+// AccessRequestsConfig configures letting people not on the allowlist request access from approvers
+type AccessRequestsConfig struct {
+	Enabled           bool     `yaml:"enabled"`
+	Approvers         []string `yaml:"approvers" validate:"dive,email"`
+	RequestValidHours int      `yaml:"request_valid_hours" validate:"gte=1"`
+	GrantDays         int      `yaml:"grant_days" validate:"gte=0"`
+}
+
+// AuthzWebhookConfig configures asking an external service, e.g. an HR system, who is allowed to log in
+type AuthzWebhookConfig struct {
+	URL            string `yaml:"url" validate:"omitempty,url"`
+	TimeoutSeconds int    `yaml:"timeout_seconds" validate:"gte=1,lte=60"`
+	CacheSeconds   int    `yaml:"cache_seconds" validate:"gte=0,lte=86400"`
+	// Allow logging in when the service can't be reached or fails, instead of denying it
+	FailOpen bool `yaml:"fail_open"`
+	// Also ask on every /api/verify-token request, for the host and path being accessed
+	VerifyToken bool `yaml:"verify_token"`
+	// Let the webhook decide on its own, instead of only for the emails the allowlist allows. Deny patterns and
+	// blocked domains still apply.
+	Standalone bool `yaml:"standalone"`
+}
+
+// PolicyRuleConfig is a named CEL expression that has to evaluate to true for access to be allowed
+type PolicyRuleConfig struct {
+	Name       string `yaml:"name" validate:"required,min=1,max=64"`
+	Expression string `yaml:"expression" validate:"required,min=1"`
+}
+
+// PolicyConfig configures the access policy evaluated on every /api/verify-token request
+type PolicyConfig struct {
+	Rules []PolicyRuleConfig `yaml:"rules" validate:"dive"`
+}
+
+// SigningKeyConfig is one of the keys in the signing key ring
+type SigningKeyConfig struct {
+	ID             string `yaml:"id" validate:"required,min=1,max=64"`
+	Key            string `yaml:"key" validate:"required,min=16,max=255"`
+	PrivateKeyFile string `yaml:"private_key_file" validate:"max=4096"`
+	Active         bool   `yaml:"active"`
+	Retired        bool   `yaml:"retired"`
+}
+
 // Config provides all the configuration parsed from praga.yaml
 type Config struct {
-	Title      string           `yaml:"title" validate:"min=1,max=64"`
-	Brand      string           `yaml:"brand" validate:"min=1,max=64"`
-	Support    string           `yaml:"support" validate:"min=1,max=255"`
-	SigningKey string           `yaml:"signing_key" validate:"required,min=16,max=64"`
-	CookieAuth CookieAuthConfig `yaml:"cookie_auth"`
-	Auth       AuthConfig       `yaml:"auth"`
-	Email      EmailConfig      `yaml:"email"`
-	Mailjet    MailjetConfig    `yaml:"mailjet"`
-	Server     ServerConfig     `yaml:"server"`
-	JWT        JWTConfig        `yaml:"jwt"`
+	Title          string               `yaml:"title" validate:"min=1,max=64"`
+	Brand          string               `yaml:"brand" validate:"min=1,max=64"`
+	Support        string               `yaml:"support" validate:"min=1,max=255"`
+	URL            string               `yaml:"url" validate:"omitempty,url"`
+	SigningKey     string               `yaml:"signing_key" validate:"required_without=SigningKeys,omitempty,min=16,max=64"`
+	SigningKeys    []SigningKeyConfig   `yaml:"signing_keys" validate:"dive"`
+	CookieAuth     CookieAuthConfig     `yaml:"cookie_auth"`
+	Auth           AuthConfig           `yaml:"auth"`
+	Email          EmailConfig          `yaml:"email"`
+	Mailjet        MailjetConfig        `yaml:"mailjet"`
+	Server         ServerConfig         `yaml:"server"`
+	JWT            JWTConfig            `yaml:"jwt"`
+	Metrics        MetricsConfig        `yaml:"metrics"`
+	Log            LogConfig            `yaml:"log"`
+	Admin          AdminConfig          `yaml:"admin"`
+	Sites          []SiteConfig         `yaml:"sites" validate:"dive"`
+	Sessions       SessionsConfig       `yaml:"sessions"`
+	AccessRequests AccessRequestsConfig `yaml:"access_requests"`
+	AuthzWebhook   AuthzWebhookConfig   `yaml:"authz_webhook"`
+	Policy         PolicyConfig         `yaml:"policy"`
+	DevMode        bool                 `yaml:"dev_mode"`
 }
 
 // LoadConfig loads a praga.yaml file and parses it into a Config
 func LoadConfig(configPath string) (bool, Config) {
+	c, err := readConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	return validateConfig(c), *c
+}
+
+// readConfig reads the configuration file and applies defaults and environment overrides
+func readConfig(configPath string) (*Config, error) {
 	c := &Config{}
 	c.Title = "Login"
 	c.Brand = "Private Area"
@@ -88,17 +287,28 @@ func LoadConfig(configPath string) (bool, Config) {
 	c.Auth.Mode = "email"
 	c.Email.EmailProvider = "mailjet"
 	c.JWT.ValidSeconds = 86400
+	c.JWT.Algorithm = "HS256"
 	c.Server.Host = "0.0.0.0"
 	c.Server.Port = 8086
 	c.Server.ListenType = "http"
+	c.Server.TrustedProxies = []string{"127.0.0.1", "::1"}
+	c.Log.Level = "info"
+	c.Log.Format = "text"
+	c.JWT.Binding.IPv4Prefix = 24
+	c.JWT.Binding.IPv6Prefix = 64
+	c.Sessions.Store = "memory"
+	c.Sessions.TouchIntervalSeconds = 60
+	c.AccessRequests.RequestValidHours = 72
+	c.AuthzWebhook.TimeoutSeconds = 5
+	c.AuthzWebhook.CacheSeconds = 60
 
 	f, err := os.ReadFile(configPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	if err := yaml.Unmarshal(f, c); err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	// Allow PRAGA_SIGNING_KEY environment override
@@ -108,7 +318,29 @@ func LoadConfig(configPath string) (bool, Config) {
 	}
 
 	if c.SigningKey == "openssl rand -hex 32" {
-		log.Fatal("Generate a new signing_key in the configuration e.g. with: openssl rand -hex 32")
+		return nil, errors.New("generate a new signing_key in the configuration e.g. with: openssl rand -hex 32")
+	}
+
+	for _, key := range c.SigningKeys {
+		if key.Key == "openssl rand -hex 32" {
+			return nil, fmt.Errorf("generate a new key for signing key %s e.g. with: openssl rand -hex 32", key.ID)
+		}
+	}
+
+	// Allow PRAGA_ADMIN_TOKEN environment override
+	adminToken := os.Getenv("PRAGA_ADMIN_TOKEN")
+	if adminToken != "" {
+		c.Admin.Token = adminToken
+	}
+
+	// Allow PRAGA_AUDIT_HASH_KEY environment override
+	auditHashKey := os.Getenv("PRAGA_AUDIT_HASH_KEY")
+	if auditHashKey != "" {
+		c.Log.Audit.HashKey = auditHashKey
+	}
+
+	if c.Log.Audit.HashKey == "openssl rand -hex 32" {
+		return nil, errors.New("generate a new log.audit.hash_key in the configuration e.g. with: openssl rand -hex 32")
 	}
 
 	// Allow MJ_APIKEY_PRIVATE and MJ_APIKEY_PUBLIC environment overrides
@@ -124,10 +356,15 @@ func LoadConfig(configPath string) (bool, Config) {
 
 	if c.Email.EmailProvider == "mailjet" {
 		if c.Mailjet.APIKeyPublic == "" || c.Mailjet.APIKeyPrivate == "" {
-			log.Fatal("Mailjet provider missing API key configuration")
+			return nil, errors.New("mailjet provider missing API key configuration")
 		}
 	}
 
+	return c, nil
+}
+
+// validateConfig checks the configuration is valid, logging any issues found
+func validateConfig(c *Config) bool {
 	validate := validator.New()
 	validate.RegisterTagNameFunc(func(fld reflect.StructField) string {
 		name := strings.SplitN(fld.Tag.Get("yaml"), ",", 2)[0]
@@ -141,13 +378,86 @@ func LoadConfig(configPath string) (bool, Config) {
 		var validationErrors validator.ValidationErrors
 		if errors.As(err, &validationErrors) {
 			for _, verr := range validationErrors {
-				log.Print(strings.Replace(verr.Error(), "Config.", "", 1))
+				slog.Error(strings.Replace(verr.Error(), "Config.", "", 1))
 			}
 		} else {
-			log.Print(err)
+			slog.Error("Invalid configuration", slog.Any("error", err))
+		}
+		return false
+	}
+
+	if _, err := newKeyRing(*c); err != nil {
+		slog.Error("Invalid signing_keys", slog.Any("error", err))
+		return false
+	}
+
+	if err := checkEmailConfig(c.Email); err != nil {
+		slog.Error("Invalid email configuration", slog.Any("error", err))
+		return false
+	}
+
+	if err := newCodeFormat(c.Auth.Code).check(); err != nil {
+		slog.Error("Invalid auth.code", slog.Any("error", err))
+		return false
+	}
+
+	if c.Log.Audit.HashEmails && c.Log.Audit.Path != "" && c.Log.Audit.HashKey == "" {
+		slog.Error("log.audit.hash_key is required with log.audit.hash_emails")
+		return false
+	}
+
+	// Refreshing would otherwise keep sessions going forever, or refresh tokens that have already expired
+	if c.JWT.RefreshAfterSeconds > 0 && c.JWT.MaxSessionSeconds == 0 {
+		slog.Error("jwt.max_session_seconds is required with jwt.refresh_after_seconds")
+		return false
+	}
+	if c.JWT.RefreshAfterSeconds > 0 && c.JWT.RefreshAfterSeconds >= c.JWT.ValidSeconds {
+		slog.Error("jwt.refresh_after_seconds must be shorter than jwt.valid_seconds")
+		return false
+	}
+
+	if c.Sessions.IdleTimeoutSeconds > 0 && c.Sessions.TouchIntervalSeconds >= c.Sessions.IdleTimeoutSeconds {
+		slog.Error("sessions.touch_interval_seconds must be shorter than sessions.idle_timeout_seconds")
+		return false
+	}
+
+	// The memory store forgets the activity on restart, after which every session would look idle since login
+	if c.Sessions.IdleTimeoutSeconds > 0 && c.Sessions.Store != "file" && !c.Sessions.Registry {
+		slog.Error("sessions.idle_timeout_seconds needs sessions.store: file or sessions.registry")
+		return false
+	}
+
+	if _, err := compilePolicy(c.Policy); err != nil {
+		slog.Error("Invalid access policy", slog.Any("error", err))
+		return false
+	}
+
+	if c.AccessRequests.Enabled {
+		if c.URL == "" {
+			slog.Error("url is required for the links sent in access requests")
+			return false
+		}
+		if len(c.AccessRequests.Approvers) == 0 {
+			slog.Error("access_requests.approvers is required for access requests")
+			return false
+		}
+		if c.Sessions.Store != "file" {
+			slog.Error("Access requests need sessions.store: file to keep the approved emails")
+			return false
+		}
+	}
+
+	if c.AuthzWebhook.Standalone && c.AuthzWebhook.URL == "" {
+		slog.Error("authz_webhook.url is required for authz_webhook.standalone")
+		return false
+	}
+
+	for _, listener := range c.Server.listenerConfigs() {
+		if listener.Type == "https" && (listener.TLS.CertFile == "" || listener.TLS.KeyFile == "") {
+			slog.Error("tls.cert_file and tls.key_file are required for https listeners", slog.String("address", listener.Address))
+			return false
 		}
-		return false, *c
 	}
 
-	return true, *c
+	return true
 }
@@ -0,0 +1,133 @@
+package backend
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateConfigSlidingSessions(t *testing.T) {
+	tests := []struct {
+		refreshAfter int
+		maxSession   int
+		valid        bool
+	}{
+		{0, 0, true},
+		{3600, 604800, true},
+		{3600, 0, false},
+		{86400, 604800, false},
+		{90000, 604800, false},
+	}
+
+	// The defaults readConfig would fill in
+	base := getTestConfig()
+	base.SigningKey = "abcdefghijklmnopqrstuvwxyz123456"
+	base.Server.Socket = "/run/praga/praga.sock"
+	base.Log = LogConfig{Level: "info", Format: "text"}
+	base.Sessions.Store = "memory"
+	base.AccessRequests.RequestValidHours = 72
+	base.AuthzWebhook.TimeoutSeconds = 5
+
+	for _, test := range tests {
+		c := base
+		c.JWT.RefreshAfterSeconds = test.refreshAfter
+		c.JWT.MaxSessionSeconds = test.maxSession
+		if valid := validateConfig(&c); valid != test.valid {
+			t.Errorf("Configuration with refresh_after_seconds %d and max_session_seconds %d was valid: %v, expected %v",
+				test.refreshAfter, test.maxSession, valid, test.valid)
+		}
+	}
+}
+
+func TestReloadKeepsDebug(t *testing.T) {
+	t.Setenv("MJ_APIKEY_PUBLIC", "public")
+	t.Setenv("MJ_APIKEY_PRIVATE", "private")
+	defer logLevel.Set(slog.LevelInfo)
+
+	path := filepath.Join(t.TempDir(), "praga.yaml")
+	contents := `
+signing_key: abcdefghijklmnopqrstuvwxyz123456
+server:
+  socket: /run/praga/praga.sock
+cookie_auth:
+  domain: example.com
+log:
+  level: warn
+email:
+  from: login@example.com
+  from_name: Login
+  valid_domains: [example.com]
+`
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &Server{Config: getTestConfig(), ConfigPath: path, Debug: true}
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("Log level is %s after reloading with debug forced", logLevel.Level())
+	}
+
+	srv.Debug = false
+	if err := srv.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if logLevel.Level() != slog.LevelWarn {
+		t.Errorf("Log level is %s after reloading, expected the configured %s", logLevel.Level(), slog.LevelWarn)
+	}
+}
+
+func TestValidateConfigAuditHashKey(t *testing.T) {
+	c := getTestConfig()
+	c.SigningKey = "abcdefghijklmnopqrstuvwxyz123456"
+	c.Server.Socket = "/run/praga/praga.sock"
+	c.Log = LogConfig{Level: "info", Format: "text"}
+	c.Sessions.Store = "memory"
+	c.AccessRequests.RequestValidHours = 72
+	c.AuthzWebhook.TimeoutSeconds = 5
+	c.Log.Audit = AuditConfig{Path: "/var/log/praga/audit.log", HashEmails: true}
+
+	if validateConfig(&c) {
+		t.Error("Configuration hashing emails in the audit log without hash_key was valid")
+	}
+
+	c.Log.Audit.HashKey = "audit-hash-key-1234567890"
+	if !validateConfig(&c) {
+		t.Error("Configuration hashing emails in the audit log with hash_key was invalid")
+	}
+}
+
+func TestValidateConfigIdleTimeout(t *testing.T) {
+	tests := []struct {
+		store    string
+		registry bool
+		valid    bool
+	}{
+		{"memory", false, false},
+		{"memory", true, true},
+		{"file", false, true},
+	}
+
+	base := getTestConfig()
+	base.SigningKey = "abcdefghijklmnopqrstuvwxyz123456"
+	base.Server.Socket = "/run/praga/praga.sock"
+	base.Log = LogConfig{Level: "info", Format: "text"}
+	base.AccessRequests.RequestValidHours = 72
+	base.AuthzWebhook.TimeoutSeconds = 5
+	base.Sessions.Path = "/var/lib/praga/sessions.db"
+	base.Sessions.IdleTimeoutSeconds = 7200
+	base.Sessions.TouchIntervalSeconds = 60
+
+	for _, test := range tests {
+		c := base
+		c.Sessions.Store = test.store
+		c.Sessions.Registry = test.registry
+		if valid := validateConfig(&c); valid != test.valid {
+			t.Errorf("Idle timeout with sessions.store %s and registry %v was valid: %v, expected %v",
+				test.store, test.registry, valid, test.valid)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package backend
+
+/*
+ * Encrypted tokens use a compact authenticated encryption envelope around the signed JWT, so the claims can't be
+ * read by anything else seeing the cookie on the shared domain:
+ *
+ *   praga1.<base64url kid>.<base64url nonce + AES-256-GCM ciphertext>
+ *
+ * The prefix and kid are authenticated as additional data.
+ */
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const tokenEnvelopePrefix = "praga1."
+
+// newTokenAEAD creates the cipher for encrypting tokens with the key
+func newTokenAEAD(key *ringKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealToken encrypts the token with the active key
+func (kr *keyRing) sealToken(token string) (string, error) {
+	aead, err := newTokenAEAD(kr.active)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	header := tokenEnvelopePrefix + base64.RawURLEncoding.EncodeToString([]byte(kr.active.id))
+	sealed := aead.Seal(nonce, nonce, []byte(token), []byte(header))
+	return header + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openToken decrypts an encrypted token, tokens that are not encrypted are returned as they are
+func (kr *keyRing) openToken(token string) (string, error) {
+	if !strings.HasPrefix(token, tokenEnvelopePrefix) {
+		return token, nil
+	}
+
+	header, payload, ok := strings.Cut(strings.TrimPrefix(token, tokenEnvelopePrefix), ".")
+	if !ok {
+		return "", errors.New("malformed encrypted token")
+	}
+
+	kid, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted token key ID: %w", err)
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted token payload: %w", err)
+	}
+
+	for _, key := range kr.verificationKeys() {
+		if key.id != string(kid) {
+			continue
+		}
+
+		aead, err := newTokenAEAD(key)
+		if err != nil {
+			return "", err
+		}
+
+		if len(sealed) < aead.NonceSize() {
+			return "", errors.New("encrypted token too short")
+		}
+
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(tokenEnvelopePrefix+header))
+		if err != nil {
+			return "", fmt.Errorf("error decrypting token: %w", err)
+		}
+		return string(plaintext), nil
+	}
+
+	return "", fmt.Errorf("unknown or retired encryption key %s", kid)
+}
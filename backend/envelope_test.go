@@ -0,0 +1,52 @@
+package backend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTokenEnvelope(t *testing.T) {
+	keys, err := newKeyRing(getTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := keys.sealToken("header.payload.signature")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(sealed, tokenEnvelopePrefix) || strings.Contains(sealed, "payload") {
+		t.Errorf("Token was not encrypted: %s", sealed)
+	}
+
+	opened, err := keys.openToken(sealed)
+	if err != nil || opened != "header.payload.signature" {
+		t.Errorf("Got %s, %v when opening token", opened, err)
+	}
+
+	// Plain tokens are passed through
+	if opened, err := keys.openToken("header.payload.signature"); err != nil || opened != "header.payload.signature" {
+		t.Errorf("Got %s, %v for plain token", opened, err)
+	}
+
+	// Tampering is detected
+	tampered := sealed[:len(sealed)-2] + "AA"
+	if tampered == sealed {
+		tampered = sealed[:len(sealed)-2] + "BB"
+	}
+	if _, err := keys.openToken(tampered); err == nil {
+		t.Error("Tampered token was opened")
+	}
+
+	// Other keys can't open it
+	otherConfig := getTestConfig()
+	otherConfig.SigningKey = "other-signing-key"
+	otherKeys, err := newKeyRing(otherConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := otherKeys.openToken(sealed); err == nil {
+		t.Error("Token was opened with another key")
+	}
+}
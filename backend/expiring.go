@@ -0,0 +1,43 @@
+package backend
+
+import (
+	"slices"
+	"time"
+)
+
+// ExpiringEntry is an allowlist entry that is only valid until a certain time
+type ExpiringEntry struct {
+	Entry      string
+	Group      string
+	ValidUntil time.Time
+}
+
+// ExpiringEntries lists the entries of the configuration that expire before the given time, including those that
+// have already expired, soonest first
+func ExpiringEntries(config Config, before time.Time) []ExpiringEntry {
+	var entries []ExpiringEntry
+	add := func(entry string, group string, v validity) {
+		if !v.until.IsZero() && v.until.Before(before) {
+			entries = append(entries, ExpiringEntry{Entry: entry, Group: group, ValidUntil: v.until})
+		}
+	}
+
+	for _, entry := range config.Email.ValidEmails {
+		add(entry.Email, "", validity{from: entry.ValidFrom, until: entry.ValidUntil})
+	}
+
+	for _, group := range config.Email.Groups {
+		groupValidity := validity{from: group.ValidFrom, until: group.ValidUntil}
+		for _, domain := range group.Domains {
+			add(domain, group.Name, groupValidity)
+		}
+		for _, entry := range group.Emails {
+			add(entry.Email, group.Name, validity{from: entry.ValidFrom, until: entry.ValidUntil}.within(groupValidity))
+		}
+	}
+
+	slices.SortStableFunc(entries, func(a, b ExpiringEntry) int {
+		return a.ValidUntil.Compare(b.ValidUntil)
+	})
+	return entries
+}
@@ -0,0 +1,40 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiringEntries(t *testing.T) {
+	now := time.Now()
+	config := Config{Email: EmailConfig{
+		ValidEmails: []EmailEntry{
+			{Email: "user@example.com"},
+			{Email: "auditor@example.com", ValidUntil: now.Add(48 * time.Hour)},
+			{Email: "later@example.com", ValidUntil: now.Add(60 * 24 * time.Hour)},
+			{Email: "expired@example.com", ValidUntil: now.Add(-time.Hour)},
+		},
+		Groups: []EmailGroupConfig{{
+			Name:       "contractors",
+			Domains:    []string{"contractor.example"},
+			Emails:     []EmailEntry{{Email: "early@example.com", ValidUntil: now.Add(time.Hour)}},
+			ValidUntil: now.Add(24 * time.Hour),
+		}},
+	}}
+
+	entries := ExpiringEntries(config, now.Add(7*24*time.Hour))
+
+	expected := []string{"expired@example.com", "early@example.com", "contractor.example", "auditor@example.com"}
+	if len(entries) != len(expected) {
+		t.Fatalf("Got %d entries, expected %d: %v", len(entries), len(expected), entries)
+	}
+	for i, entry := range entries {
+		if entry.Entry != expected[i] {
+			t.Errorf("Entry %d was %s, expected %s", i, entry.Entry, expected[i])
+		}
+	}
+
+	if entries[2].Group != "contractors" || !entries[2].ValidUntil.Equal(now.Add(24*time.Hour)) {
+		t.Errorf("Group entry was %+v", entries[2])
+	}
+}
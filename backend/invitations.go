@@ -0,0 +1,286 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+// Purpose of the signed invitation links
+const invitationLinkPurpose = "invitation"
+
+// Maximum number of days an invitation link is valid for, used invitations are remembered until they expire
+const maxInvitationDays = 365
+
+var errInvitationClosed = errors.New("invitation has been used, cancelled or revoked")
+
+// Used invitations are remembered in the session store, which the memory store would forget on restart
+var errInvitationsUnavailable = errors.New("invitations need sessions.store: file to remember the accepted ones")
+
+// Invitation pre-authorizes an email to log in, it is added to the dynamic allowlist once the link is followed
+type Invitation struct {
+	ID     string   `json:"id"`
+	Email  string   `json:"email"`
+	Groups []string `json:"groups,omitempty"`
+	// Days the access is valid for once the invitation is accepted, zero if it does not expire
+	AccessDays int       `json:"access_days,omitempty"`
+	InvitedBy  string    `json:"invited_by"`
+	Issued     time.Time `json:"issued"`
+	Expires    time.Time `json:"expires"`
+}
+
+// validUntil works out when the access given by the invitation expires, zero if it does not
+func (inv *Invitation) validUntil(now time.Time) time.Time {
+	if inv.AccessDays == 0 {
+		return time.Time{}
+	}
+	return now.AddDate(0, 0, inv.AccessDays)
+}
+
+// MakeInvitation creates the link inviting the email to log in, valid until it expires, filling in the ID of the
+// invitation for cancelling it
+func MakeInvitation(srv *Server, invitation *Invitation, expires time.Time) (string, error) {
+	if srv.Config.URL == "" {
+		return "", errors.New("url is required for invitation links")
+	}
+	if srv.Config.Sessions.Store != "file" {
+		return "", errInvitationsUnavailable
+	}
+
+	now := time.Now()
+	if expires.After(now.AddDate(0, 0, maxInvitationDays)) {
+		return "", fmt.Errorf("invitations can be valid for at most %d days", maxInvitationDays)
+	}
+
+	email, err := normalizeEmail(srv.Config.Email, invitation.Email)
+	if err != nil {
+		return "", err
+	}
+	invitation.Email = email
+
+	if denied, rule := srv.emailAllowlist().denied(email); denied {
+		return "", fmt.Errorf("%s is denied by %s", email, rule)
+	}
+
+	for _, group := range invitation.Groups {
+		if _, ok := srv.emailAllowlist().groups[group]; !ok {
+			return "", fmt.Errorf("unknown group %s", group)
+		}
+	}
+
+	invitation.ID = uuid.New().String()
+	invitation.Issued = now
+	invitation.Expires = expires
+	token, err := srv.signingKeys().signLink(invitationLinkPurpose, invitation, expires)
+	if err != nil {
+		return "", err
+	}
+	return publicURL(srv.Config, "/invitation/?token="+url.QueryEscape(token)), nil
+}
+
+// openInvitation reads the invitation link, nil if it is not valid
+func openInvitation(srv *Server, r *http.Request, token string) *Invitation {
+	invitation := &Invitation{}
+	if err := srv.signingKeys().openLink(invitationLinkPurpose, token, invitation); err != nil {
+		slog.DebugContext(r.Context(), "Invalid invitation link", slog.Any("error", err))
+		return nil
+	}
+	return invitation
+}
+
+// checkInvitation checks the invitation can still be accepted, reporting if the email's current access came from it
+func checkInvitation(srv *Server, invitation *Invitation) (bool, error) {
+	if srv.Config.Sessions.Store != "file" {
+		return false, errInvitationsUnavailable
+	}
+
+	existing, err := srv.sessionStorage().getAccessGrant(invitation.Email)
+	if err != nil {
+		return false, err
+	}
+
+	// Following the link again only sends a new code
+	if existing != nil && existing.InvitationID == invitation.ID && existing.Revoked.IsZero() {
+		return true, nil
+	}
+
+	// Access revoked after the invitation was made is only given back by a new invitation
+	if existing != nil && !existing.Revoked.IsZero() && !existing.Revoked.Before(invitation.Issued) {
+		return false, errInvitationClosed
+	}
+
+	closed, err := srv.sessionStorage().invitationClosed(invitation.ID)
+	if err != nil {
+		return false, err
+	}
+	if closed {
+		return false, errInvitationClosed
+	}
+	return false, nil
+}
+
+// acceptInvitation adds the invited email to the dynamic allowlist, each invitation is only accepted once
+func acceptInvitation(srv *Server, invitation *Invitation) error {
+	accepted, err := checkInvitation(srv, invitation)
+	if err != nil || accepted {
+		return err
+	}
+
+	// Closing the invitation first ensures it is accepted once even if the link is followed twice at the same time
+	closed, err := srv.sessionStorage().closeInvitation(invitation.ID, invitation.Expires)
+	if err != nil {
+		return err
+	}
+	if closed {
+		return errInvitationClosed
+	}
+
+	now := time.Now()
+	return srv.sessionStorage().putAccessGrant(&accessGrant{
+		Email:        invitation.Email,
+		GrantedBy:    invitation.InvitedBy,
+		Reason:       "invitation",
+		Granted:      now,
+		ValidUntil:   invitation.validUntil(now),
+		Groups:       invitation.Groups,
+		InvitationID: invitation.ID,
+	})
+}
+
+// inviteEmail creates an invitation from the admin API, optionally sending it to the invited email
+func inviteEmail(srv *Server, r *http.Request, req adminInvitationRequest) (*adminInvitationResponse, error) {
+	validDays := req.ValidDays
+	if validDays == 0 {
+		validDays = 7
+	}
+	expires := time.Now().AddDate(0, 0, validDays)
+
+	invitation := &Invitation{
+		Email:      req.Email,
+		Groups:     req.Groups,
+		AccessDays: req.AccessDays,
+		InvitedBy:  "admin API",
+	}
+	link, err := MakeInvitation(srv, invitation, expires)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.audit.record(r, auditInvitation, req.Email, slog.String("invitation_id", invitation.ID), slog.String("groups", strings.Join(req.Groups, ",")))
+
+	if req.Send {
+		sendNotice(r.Context(), srv, strings.TrimSpace(req.Email), fmt.Sprintf("Invitation to %s", srv.Config.Brand),
+			fmt.Sprintf("You have been invited to %s, follow the link to log in:\n\n%s\n\nThe link is valid until %s.",
+				srv.Config.Brand, link, expires.Format(time.RFC1123)))
+	}
+
+	return &adminInvitationResponse{ID: invitation.ID, URL: link, Expires: expires}, nil
+}
+
+// cancelInvitation stops a pending invitation from being accepted, the access of already accepted ones has to be
+// revoked instead
+func cancelInvitation(srv *Server, id string) error {
+	_, err := srv.sessionStorage().closeInvitation(id, time.Now().AddDate(0, 0, maxInvitationDays))
+	return err
+}
+
+func registerInvitationRoutes(srv *Server, r *chi.Mux) {
+	ipLimiter := newRateLimiter()
+	emailLimiter := newRateLimiter()
+
+	r.Route("/api/invitations", func(r chi.Router) {
+		// Show the invitation behind a link, so following the link does not accept it by itself
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			invitation := openInvitation(srv, r, r.URL.Query().Get("token"))
+			if invitation == nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			if _, err := checkInvitation(srv, invitation); errors.Is(err, errInvitationClosed) {
+				http.Error(w, err.Error(), http.StatusGone)
+				return
+			} else if errors.Is(err, errInvitationsUnavailable) {
+				slog.WarnContext(r.Context(), "Invitation can't be accepted", slog.Any("error", err))
+				w.WriteHeader(404)
+				return
+			} else if err != nil {
+				slog.ErrorContext(r.Context(), "Error checking invitation", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			response := invitationResponse{Email: invitation.Email, Groups: invitation.Groups}
+			if validUntil := invitation.validUntil(time.Now()); !validUntil.IsZero() {
+				response.ValidUntil = &validUntil
+			}
+
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+		})
+
+		// Accept the invitation and send a code to log in with
+		r.Post("/accept", func(w http.ResponseWriter, r *http.Request) {
+			var req invitationRequest
+			if r.Body == nil || json.NewDecoder(r.Body).Decode(&req) != nil || !validateRequest(r.Context(), req) {
+				w.WriteHeader(400)
+				return
+			}
+
+			invitation := openInvitation(srv, r, req.Token)
+			if invitation == nil {
+				w.WriteHeader(400)
+				return
+			}
+
+			if rateLimited(srv, w, r, ipLimiter, "ip", clientIP(r)) || rateLimited(srv, w, r, emailLimiter, "email", invitation.Email) {
+				return
+			}
+
+			err := acceptInvitation(srv, invitation)
+			if errors.Is(err, errInvitationClosed) {
+				slog.DebugContext(r.Context(), "Invitation can't be accepted", slog.String("invitation_id", invitation.ID), slog.Any("error", err))
+				http.Error(w, err.Error(), http.StatusGone)
+				return
+			}
+			if errors.Is(err, errInvitationsUnavailable) {
+				slog.WarnContext(r.Context(), "Invitation can't be accepted", slog.Any("error", err))
+				w.WriteHeader(404)
+				return
+			}
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error accepting invitation", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			allowed := mayLogIn(r.Context(), srv, invitation.Email, "")
+			srv.audit.record(r, auditInvitationUsed, invitation.Email, slog.String("invitation_id", invitation.ID), slog.Bool("allowed", allowed))
+
+			// The same as requesting a code on the login page, e.g. the access may have since been revoked
+			if !allowed {
+				slog.DebugContext(r.Context(), "Invited email is not allowed to log in", slog.String("email", invitation.Email))
+				w.WriteHeader(204)
+				return
+			}
+
+			code, err := issueCode(srv, invitation.Email)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error issuing code", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+			sendCode(r.Context(), srv, invitation.Email, code)
+			w.WriteHeader(204)
+		})
+	})
+}
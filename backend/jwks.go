@@ -0,0 +1,78 @@
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"math/big"
+)
+
+// jwk is a public key in the JSON Web Key format, RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+}
+
+func encodeJWKBytes(value []byte) string {
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+// publicJWK converts the public half of the key to a JWK, false for symmetric keys that must not be shared
+func (rk *ringKey) publicJWK(alg string) (jwk, bool) {
+	if rk.privateKey == nil {
+		return jwk{}, false
+	}
+
+	key := jwk{
+		Kid: rk.id,
+		Use: "sig",
+		Alg: alg,
+	}
+
+	switch pub := rk.privateKey.Public().(type) {
+	case ed25519.PublicKey:
+		key.Kty = "OKP"
+		key.Crv = "Ed25519"
+		key.X = encodeJWKBytes(pub)
+	case *ecdsa.PublicKey:
+		ecdhKey, err := pub.ECDH()
+		if err != nil {
+			return jwk{}, false
+		}
+
+		// Uncompressed point format 0x04 || X || Y
+		point := ecdhKey.Bytes()
+		size := (len(point) - 1) / 2
+		key.Kty = "EC"
+		key.Crv = pub.Curve.Params().Name
+		key.X = encodeJWKBytes(point[1 : 1+size])
+		key.Y = encodeJWKBytes(point[1+size:])
+	case *rsa.PublicKey:
+		key.Kty = "RSA"
+		key.N = encodeJWKBytes(pub.N.Bytes())
+		key.E = encodeJWKBytes(big.NewInt(int64(pub.E)).Bytes())
+	default:
+		return jwk{}, false
+	}
+
+	return key, true
+}
+
+// jwks lists the public keys for all the keys still accepted for verifying tokens
+func (kr *keyRing) jwks() jwksResponse {
+	response := jwksResponse{Keys: []jwk{}}
+	for _, key := range kr.verificationKeys() {
+		if publicKey, ok := key.publicJWK(kr.method.Alg()); ok {
+			response.Keys = append(response.Keys, publicKey)
+		}
+	}
+	return response
+}
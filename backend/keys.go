@@ -0,0 +1,274 @@
+package backend
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Used for single signing_key configurations
+const defaultKeyID = "default"
+
+// ringKey holds the keys derived from one configured secret, so codes and tokens never share a key
+type ringKey struct {
+	id       string
+	secret   string
+	tokenKey []byte
+	codeKey  string
+	retired  bool
+
+	// For encrypted tokens
+	encryptionKey []byte
+	// For signed links sent by email
+	linkKey string
+
+	// Only for asymmetric token signing algorithms
+	privateKey crypto.Signer
+}
+
+// keyRing contains all the configured signing keys, new codes and tokens are made with the active one
+type keyRing struct {
+	method jwt.SigningMethod
+	active *ringKey
+	keys   []*ringKey
+	// Accept tokens without a kid header, see tokenKeyFunc
+	acceptLegacy bool
+}
+
+// Token signing algorithms supported in jwt.algorithm
+var signingMethods = map[string]jwt.SigningMethod{
+	"HS256": jwt.SigningMethodHS256,
+	"EdDSA": jwt.SigningMethodEdDSA,
+	"ES256": jwt.SigningMethodES256,
+	"RS256": jwt.SigningMethodRS256,
+}
+
+// deriveKey produces a key for the given purpose from the configured secret
+func deriveKey(secret string, purpose string) []byte {
+	return getHash(secret, "praga "+purpose)
+}
+
+func newRingKey(config SigningKeyConfig, method jwt.SigningMethod) (*ringKey, error) {
+	key := &ringKey{
+		id:       config.ID,
+		secret:   config.Key,
+		tokenKey: deriveKey(config.Key, "token"),
+		codeKey:  hex.EncodeToString(deriveKey(config.Key, "code")),
+		retired:  config.Retired,
+
+		encryptionKey: deriveKey(config.Key, "encryption"),
+		linkKey:       hex.EncodeToString(deriveKey(config.Key, "links")),
+	}
+
+	if method == jwt.SigningMethodHS256 {
+		return key, nil
+	}
+
+	if config.PrivateKeyFile == "" {
+		return nil, fmt.Errorf("signing key %s needs a private_key_file for %s", config.ID, method.Alg())
+	}
+
+	privateKey, err := loadPrivateKey(config.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading private key for signing key %s: %w", config.ID, err)
+	}
+
+	if err := checkPrivateKey(privateKey, method); err != nil {
+		return nil, fmt.Errorf("signing key %s: %w", config.ID, err)
+	}
+
+	key.privateKey = privateKey
+	return key, nil
+}
+
+// loadPrivateKey reads a PEM encoded PKCS #8, SEC 1 EC or PKCS #1 RSA private key
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// checkPrivateKey ensures the key is of the right type for the signing algorithm
+func checkPrivateKey(key crypto.Signer, method jwt.SigningMethod) error {
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		if method == jwt.SigningMethodEdDSA {
+			return nil
+		}
+	case *ecdsa.PrivateKey:
+		if method == jwt.SigningMethodES256 && k.Curve == elliptic.P256() {
+			return nil
+		}
+	case *rsa.PrivateKey:
+		if method == jwt.SigningMethodRS256 {
+			if k.N.BitLen() < 2048 {
+				return errors.New("RSA keys must be at least 2048 bits")
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%T can not be used for %s", key, method.Alg())
+}
+
+// signingKey gets the key to sign tokens with
+func (rk *ringKey) signingKey() interface{} {
+	if rk.privateKey != nil {
+		return rk.privateKey
+	}
+	return rk.tokenKey
+}
+
+// verificationKey gets the key to verify token signatures with
+func (rk *ringKey) verificationKey() interface{} {
+	if rk.privateKey != nil {
+		return rk.privateKey.Public()
+	}
+	return rk.tokenKey
+}
+
+// signingKeyConfigs gets the configured key ring, falling back to the single signing_key
+func (c Config) signingKeyConfigs() []SigningKeyConfig {
+	if len(c.SigningKeys) > 0 {
+		return c.SigningKeys
+	}
+
+	return []SigningKeyConfig{{ID: defaultKeyID, Key: c.SigningKey, PrivateKeyFile: c.JWT.PrivateKeyFile, Active: true}}
+}
+
+func newKeyRing(c Config) (*keyRing, error) {
+	algorithm := c.JWT.Algorithm
+	if algorithm == "" {
+		algorithm = jwt.SigningMethodHS256.Alg()
+	}
+
+	method, ok := signingMethods[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported jwt.algorithm %s", algorithm)
+	}
+
+	kr := &keyRing{method: method, acceptLegacy: c.JWT.AcceptLegacyTokens}
+	seen := map[string]bool{}
+
+	for _, config := range c.signingKeyConfigs() {
+		if seen[config.ID] {
+			return nil, fmt.Errorf("duplicate signing key id %s", config.ID)
+		}
+		seen[config.ID] = true
+
+		key, err := newRingKey(config, method)
+		if err != nil {
+			return nil, err
+		}
+		kr.keys = append(kr.keys, key)
+
+		if config.Active {
+			if kr.active != nil {
+				return nil, errors.New("only one signing key can be active")
+			}
+			if config.Retired {
+				return nil, fmt.Errorf("signing key %s can not be both active and retired", config.ID)
+			}
+			kr.active = key
+		}
+	}
+
+	if kr.active == nil {
+		return nil, errors.New("one signing key must be active")
+	}
+
+	return kr, nil
+}
+
+// verificationKeys gets all the keys that are still accepted for verifying codes and tokens
+func (kr *keyRing) verificationKeys() []*ringKey {
+	var keys []*ringKey
+	for _, key := range kr.keys {
+		if !key.retired {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// tokenKeyFunc finds the key for verifying a token based on its kid header
+func (kr *keyRing) tokenKeyFunc(token *jwt.Token) (interface{}, error) {
+	// Ensure signing method is correct
+	if token.Method.Alg() != kr.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	kid, ok := token.Header["kid"].(string)
+	if !ok {
+		if !kr.acceptLegacy || kr.method != jwt.SigningMethodHS256 {
+			return nil, errors.New("token has no kid header")
+		}
+
+		// Tokens from before key rotation support were signed directly with the secret
+		keySet := jwt.VerificationKeySet{}
+		for _, key := range kr.verificationKeys() {
+			keySet.Keys = append(keySet.Keys, []byte(key.secret))
+		}
+		return keySet, nil
+	}
+
+	for _, key := range kr.verificationKeys() {
+		if key.id == kid {
+			return key.verificationKey(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown or retired signing key %s", kid)
+}
+
+// signingKeys gets the key ring for the current configuration, built on first use after a (re)load
+func (s *Server) signingKeys() *keyRing {
+	s.keysLock.Lock()
+	defer s.keysLock.Unlock()
+
+	if s.keys == nil {
+		keys, err := newKeyRing(s.Config)
+		if err != nil {
+			// The configuration is validated on load so this should never happen
+			panic(err)
+		}
+		s.keys = keys
+	}
+
+	return s.keys
+}
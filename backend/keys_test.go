@@ -0,0 +1,232 @@
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func getKeyRingTestServer(keys []SigningKeyConfig) *Server {
+	keyConfig := getTestConfig()
+	keyConfig.SigningKeys = keys
+	return &Server{Config: keyConfig}
+}
+
+func TestKeyRingValidation(t *testing.T) {
+	invalid := [][]SigningKeyConfig{
+		{{ID: "a", Key: "key-a"}},
+		{{ID: "a", Key: "key-a", Active: true}, {ID: "b", Key: "key-b", Active: true}},
+		{{ID: "a", Key: "key-a", Active: true}, {ID: "a", Key: "key-b"}},
+		{{ID: "a", Key: "key-a", Active: true, Retired: true}},
+	}
+
+	for _, keys := range invalid {
+		c := getTestConfig()
+		c.SigningKeys = keys
+		if _, err := newKeyRing(c); err == nil {
+			t.Errorf("Key ring %+v should not be valid", keys)
+		}
+	}
+
+	kr, err := newKeyRing(getTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kr.active.id != defaultKeyID {
+		t.Errorf("Single signing_key should have id %s, got %s", defaultKeyID, kr.active.id)
+	}
+
+	if string(kr.active.tokenKey) == kr.active.codeKey || string(kr.active.tokenKey) == kr.active.secret {
+		t.Error("Token and code keys should be derived separately")
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	oldServer := getKeyRingTestServer([]SigningKeyConfig{
+		{ID: "old", Key: "old-key", Active: true},
+	})
+
+	token, err := MakeToken(oldServer, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, _, err := jwt.NewParser().ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.Header["kid"] != "old" {
+		t.Errorf("Token kid header %v, expected old", parsed.Header["kid"])
+	}
+
+	code := MakeVerifyCodeNow(oldServer.signingKeys().active.codeKey, email)
+
+	// Rotate to a new active key, the old one should still work
+	rotatedServer := getKeyRingTestServer([]SigningKeyConfig{
+		{ID: "new", Key: "new-key", Active: true},
+		{ID: "old", Key: "old-key"},
+	})
+
+	if _, err := validateToken(rotatedServer, token); err != nil {
+		t.Errorf("Token signed with the previous key failed validation: %s", err)
+	}
+
+	if !checkVerifyCodeAnyKey(rotatedServer, code, email) {
+		t.Error("Code made with the previous key failed validation")
+	}
+
+	// Once retired the old key is no longer accepted
+	retiredServer := getKeyRingTestServer([]SigningKeyConfig{
+		{ID: "new", Key: "new-key", Active: true},
+		{ID: "old", Key: "old-key", Retired: true},
+	})
+
+	if _, err := validateToken(retiredServer, token); err == nil {
+		t.Error("Token signed with a retired key passed validation")
+	}
+
+	if checkVerifyCodeAnyKey(retiredServer, code, email) {
+		t.Error("Code made with a retired key passed validation")
+	}
+}
+
+func TestLegacyTokenWithoutKid(t *testing.T) {
+	claims := &jwt.RegisteredClaims{Subject: email}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("old-key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacyServer := getKeyRingTestServer([]SigningKeyConfig{
+		{ID: "new", Key: "new-key", Active: true},
+		{ID: "old", Key: "old-key"},
+	})
+	if _, err := validateToken(legacyServer, token); err == nil {
+		t.Error("Token without kid passed validation without jwt.accept_legacy_tokens")
+	}
+
+	legacyServer.Config.JWT.AcceptLegacyTokens = true
+	legacyServer.keys = nil
+	if _, err := validateToken(legacyServer, token); err != nil {
+		t.Errorf("Token from before key rotation support failed validation: %s", err)
+	}
+
+	// Retiring the key stops its legacy tokens from working too
+	legacyServer.Config.SigningKeys[1].Retired = true
+	legacyServer.keys = nil
+	if _, err := validateToken(legacyServer, token); err == nil {
+		t.Error("Token without kid signed with a retired key passed validation")
+	}
+}
+
+// writeTestPrivateKey writes a new PKCS #8 private key suitable for the algorithm
+func writeTestPrivateKey(t *testing.T, algorithm string) string {
+	var key interface{}
+	var err error
+
+	switch algorithm {
+	case "EdDSA":
+		_, key, err = ed25519.GenerateKey(rand.Reader)
+	case "ES256":
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "RS256":
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAsymmetricTokens(t *testing.T) {
+	expectedKty := map[string]string{
+		"EdDSA": "OKP",
+		"ES256": "EC",
+		"RS256": "RSA",
+	}
+
+	for algorithm, kty := range expectedKty {
+		asymmetricConfig := getTestConfig()
+		asymmetricConfig.JWT.Algorithm = algorithm
+		asymmetricConfig.JWT.PrivateKeyFile = writeTestPrivateKey(t, algorithm)
+		asymmetricServer := &Server{Config: asymmetricConfig}
+
+		token, err := MakeToken(asymmetricServer, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := validateToken(asymmetricServer, token); err != nil {
+			t.Errorf("%s token failed validation: %s", algorithm, err)
+		}
+
+		// HS256 tokens made with the same secret must not be accepted
+		if _, err := validateToken(asymmetricServer, makeHS256TestToken(t, &testServer)); err == nil {
+			t.Errorf("HS256 token was accepted when using %s", algorithm)
+		}
+
+		req, err := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		asymmetricServer.getRouter().ServeHTTP(recorder, req)
+
+		var jwks jwksResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&jwks); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Kty != kty || jwks.Keys[0].Kid != defaultKeyID || jwks.Keys[0].Alg != algorithm {
+			t.Errorf("Unexpected JWKS for %s: %+v", algorithm, jwks)
+		}
+	}
+}
+
+func TestJWKSEmptyForHS256(t *testing.T) {
+	if keys := testServer.signingKeys().jwks().Keys; len(keys) != 0 {
+		t.Errorf("HS256 keys must not be published, got %+v", keys)
+	}
+}
+
+func TestAsymmetricKeyTypeMismatch(t *testing.T) {
+	mismatchConfig := getTestConfig()
+	mismatchConfig.JWT.Algorithm = "ES256"
+	mismatchConfig.JWT.PrivateKeyFile = writeTestPrivateKey(t, "EdDSA")
+
+	if _, err := newKeyRing(mismatchConfig); err == nil {
+		t.Error("Ed25519 key should not be accepted for ES256")
+	}
+}
+
+func makeHS256TestToken(t *testing.T, srv *Server) string {
+	token, err := MakeToken(srv, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
@@ -0,0 +1,106 @@
+package backend
+
+/*
+ * Signed links let people act on something by following a link sent to them by email, without logging in:
+ *
+ *   <base64url kid>.<base64url JSON payload>.<base64url HMAC-SHA256>
+ *
+ * The payload names the purpose of the link so a link made for one thing can't be used for another.
+ */
+
+import (
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var errLinkExpired = errors.New("link has expired")
+
+type signedLink struct {
+	Purpose string          `json:"purpose"`
+	Expires int64           `json:"exp"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// linkMAC gives the signature of the encoded key ID and payload with the key
+func linkMAC(key *ringKey, signed string) []byte {
+	return getHash(key.linkKey, signed)
+}
+
+// publicURL gives the address of the path on the public address of Praga, for links sent by email
+func publicURL(config Config, path string) string {
+	return strings.TrimSuffix(config.URL, "/") + path
+}
+
+// signLink creates a link token for the purpose with the active key, carrying the data until it expires
+func (kr *keyRing) signLink(purpose string, data interface{}, expires time.Time) (string, error) {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(signedLink{Purpose: purpose, Expires: expires.Unix(), Data: encoded})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString([]byte(kr.active.id)) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(linkMAC(kr.active, signed)), nil
+}
+
+// openLink checks the link token was made for the purpose by one of the keys still in use and has not expired,
+// reading the data it carries
+func (kr *keyRing) openLink(purpose string, link string, data interface{}) error {
+	parts := strings.Split(link, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed link")
+	}
+
+	kid, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return fmt.Errorf("malformed link key ID: %w", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("malformed link signature: %w", err)
+	}
+
+	var key *ringKey
+	for _, k := range kr.verificationKeys() {
+		if k.id == string(kid) {
+			key = k
+		}
+	}
+	if key == nil {
+		return fmt.Errorf("unknown or retired link key %s", kid)
+	}
+
+	if !hmac.Equal(signature, linkMAC(key, parts[0]+"."+parts[1])) {
+		return errors.New("invalid link signature")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("malformed link payload: %w", err)
+	}
+
+	contents := signedLink{}
+	if err := json.Unmarshal(payload, &contents); err != nil {
+		return fmt.Errorf("malformed link payload: %w", err)
+	}
+
+	if contents.Purpose != purpose {
+		return fmt.Errorf("link is for %s, not %s", contents.Purpose, purpose)
+	}
+
+	if time.Now().After(time.Unix(contents.Expires, 0)) {
+		return errLinkExpired
+	}
+
+	return json.Unmarshal(contents.Data, data)
+}
@@ -0,0 +1,65 @@
+package backend
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedLinks(t *testing.T) {
+	keys, err := newKeyRing(getTestConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type linkData struct {
+		ID string `json:"id"`
+	}
+
+	link, err := keys.signLink("test", linkData{ID: "abc"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := linkData{}
+	if err := keys.openLink("test", link, &data); err != nil || data.ID != "abc" {
+		t.Errorf("Got %v, %v when opening link", data, err)
+	}
+
+	// Links are only valid for their purpose
+	if err := keys.openLink("other", link, &data); err == nil {
+		t.Error("Link was opened for another purpose")
+	}
+
+	// Tampering is detected
+	parts := strings.Split(link, ".")
+	forged, err := keys.signLink("test", linkData{ID: "xyz"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := parts[0] + "." + strings.Split(forged, ".")[1] + "." + parts[2]
+	if err := keys.openLink("test", tampered, &data); err == nil {
+		t.Error("Tampered link was opened")
+	}
+
+	// Expired links are rejected
+	expired, err := keys.signLink("test", linkData{ID: "abc"}, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.openLink("test", expired, &data); !errors.Is(err, errLinkExpired) {
+		t.Errorf("Got %v for expired link", err)
+	}
+
+	// Other keys can't open it
+	otherConfig := getTestConfig()
+	otherConfig.SigningKey = "other-signing-key"
+	otherKeys, err := newKeyRing(otherConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := otherKeys.openLink("test", link, &data); err == nil {
+		t.Error("Link was opened with another key")
+	}
+}
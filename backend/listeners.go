@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// listenerConfigs gets all the configured listeners, falling back to the single listener settings
+func (sc ServerConfig) listenerConfigs() []ListenerConfig {
+	if len(sc.Listeners) > 0 {
+		return sc.Listeners
+	}
+
+	lc := ListenerConfig{
+		Type: sc.ListenType,
+		TLS:  sc.TLS,
+	}
+
+	if sc.ListenType == "unix" {
+		lc.Address = sc.Socket
+	} else {
+		lc.Address = fmt.Sprintf("%s:%d", sc.Host, sc.Port)
+	}
+
+	return []ListenerConfig{lc}
+}
+
+// listen opens the listener described by the configuration
+func listen(lc ListenerConfig) (net.Listener, error) {
+	switch lc.Type {
+	case "http", "https":
+		return net.Listen("tcp", lc.Address)
+	case "unix":
+		return net.Listen("unix", lc.Address)
+	}
+
+	return nil, fmt.Errorf("invalid listener type %s", lc.Type)
+}
+
+// releaseSocket cleans up a unix socket once we're done with it
+func releaseSocket(socket string) {
+	err := os.Remove(socket)
+	if err == nil || os.IsNotExist(err) {
+		slog.Info("Released socket", slog.String("socket", socket))
+	} else {
+		slog.Error("Error releasing socket", slog.String("socket", socket), slog.Any("error", err))
+	}
+}
+
+// routeGroup tells which group of routes a request path belongs to, for limiting what listeners serve
+func routeGroup(path string) string {
+	if path == "/api/verify-token" || path == "/.well-known/jwks.json" {
+		return "verify"
+	}
+
+	if path == "/metrics" {
+		return "metrics"
+	}
+
+	if strings.HasPrefix(path, "/api/admin/") {
+		return "admin"
+	}
+
+	// The frontend, its configuration and the email login API
+	return "login"
+}
+
+// restrictRoutes limits the handler to the given route groups, all routes are allowed if none are given
+func restrictRoutes(groups []string, next http.Handler) http.Handler {
+	if len(groups) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !slices.Contains(groups, routeGroup(strings.TrimSuffix(r.URL.Path, "/"))) {
+			http.NotFound(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
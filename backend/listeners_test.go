@@ -0,0 +1,87 @@
+package backend
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenerConfigsFallback(t *testing.T) {
+	listeners := config.Server.listenerConfigs()
+	if len(listeners) != 1 {
+		t.Fatalf("Expected 1 listener, got %d", len(listeners))
+	}
+
+	if listeners[0].Type != "http" || listeners[0].Address != "0.0.0.0:8086" {
+		t.Errorf("Unexpected listener %s://%s", listeners[0].Type, listeners[0].Address)
+	}
+
+	sc := ServerConfig{
+		ListenType: "unix",
+		Socket:     "/run/praga/praga.sock",
+	}
+	listeners = sc.listenerConfigs()
+	if listeners[0].Type != "unix" || listeners[0].Address != "/run/praga/praga.sock" {
+		t.Errorf("Unexpected listener %s://%s", listeners[0].Type, listeners[0].Address)
+	}
+
+	sc.Listeners = []ListenerConfig{
+		{Type: "unix", Address: "/run/praga/praga.sock"},
+		{Type: "http", Address: "10.0.0.1:8086", Routes: []string{"verify"}},
+	}
+	if len(sc.listenerConfigs()) != 2 {
+		t.Errorf("Expected configured listeners to be used")
+	}
+}
+
+func TestStartListenerFailure(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "praga.sock")
+	failConfig := getTestConfig()
+	failConfig.Server.Listeners = []ListenerConfig{
+		{Type: "unix", Address: socket},
+		{Type: "http", Address: "127.0.0.1:0"},
+		{Type: "https", Address: "127.0.0.1:0", TLS: TLSConfig{CertFile: "missing.pem", KeyFile: "missing.pem"}},
+	}
+
+	if err := (&Server{Config: failConfig}).Start(); err == nil {
+		t.Fatal("Start did not fail with a broken listener")
+	}
+
+	// The listeners opened before the broken one are cleaned up, so starting again does not find the socket in use
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket %s was left behind: %v", socket, err)
+	}
+	listener, err := listen(failConfig.Server.Listeners[0])
+	if err != nil {
+		t.Fatalf("Listening to the socket again failed: %s", err)
+	}
+	listener.Close()
+}
+
+func TestRestrictRoutes(t *testing.T) {
+	handler := restrictRoutes([]string{"verify"}, testRouter)
+
+	req, err := http.NewRequest("GET", "/api/verify-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Result().StatusCode != 401 {
+		t.Errorf("/api/verify-token returned status %d, expected %d", recorder.Result().StatusCode, 401)
+	}
+
+	req, err = http.NewRequest("GET", "/api/config", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	if recorder.Result().StatusCode != 404 {
+		t.Errorf("/api/config returned status %d, expected %d", recorder.Result().StatusCode, 404)
+	}
+}
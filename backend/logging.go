@@ -0,0 +1,181 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// Shared level so it can be changed on reload without replacing the logger
+var logLevel = new(slog.LevelVar)
+
+// requestIDHandler adds the request ID from the context to all log records
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if requestID := middleware.GetReqID(ctx); requestID != "" {
+		record.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// parseLogLevel converts the configured level name to a slog.Level, defaulting to info
+func parseLogLevel(level string) slog.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// newLogHandler creates a text or JSON log handler writing to w
+func newLogHandler(w io.Writer, format string, level slog.Leveler) slog.Handler {
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// configuredLogLevel gives the log level to use with the configuration, debug if forced on the command line
+func (s *Server) configuredLogLevel(config LogConfig) slog.Level {
+	if s.Debug {
+		return slog.LevelDebug
+	}
+	return parseLogLevel(config.Level)
+}
+
+// setupLogging configures the default logger, which the standard log package also writes through
+func setupLogging(config LogConfig, level slog.Level) {
+	logLevel.Set(level)
+
+	slog.SetDefault(slog.New(requestIDHandler{newLogHandler(os.Stderr, config.Format, logLevel)}))
+}
+
+// logRequests logs every request once it's completed
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		slog.InfoContext(r.Context(), "Request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("client_ip", clientIP(r)),
+		)
+	})
+}
+
+// Security events written to the audit log
+const (
+	auditCodeRequested   = "code_requested"
+	auditCodeBlocked     = "code_blocked"
+	auditCodeVerified    = "code_verified"
+	auditLoginFailed     = "login_failed"
+	auditTokenRejected   = "token_rejected"
+	auditLogout          = "logout"
+	auditSessionRevoked  = "session_revoked"
+	auditAccessRequested = "access_requested"
+	auditAccessApproved  = "access_approved"
+	auditAccessDenied    = "access_denied"
+	auditInvitation      = "invitation_created"
+	auditInvitationUsed  = "invitation_accepted"
+	auditInvitationEnded = "invitation_cancelled"
+)
+
+// auditLog writes security events as JSON lines to an append-only file
+type auditLog struct {
+	file       *os.File
+	logger     *slog.Logger
+	hashEmails bool
+	hashKey    string
+}
+
+// newAuditLog opens the audit log file for appending, nil if no audit log is configured
+func newAuditLog(config AuditConfig) (*auditLog, error) {
+	if config.Path == "" {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(config.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auditLog{
+		file:       file,
+		logger:     slog.New(slog.NewJSONHandler(file, nil)),
+		hashEmails: config.HashEmails,
+		hashKey:    config.HashKey,
+	}, nil
+}
+
+// Close the underlying file
+func (al *auditLog) Close() error {
+	if al == nil {
+		return nil
+	}
+	return al.file.Close()
+}
+
+// emailAttr gives the email in clear text or as a keyed hash so events can still be correlated
+func (al *auditLog) emailAttr(email string) slog.Attr {
+	if al.hashEmails {
+		hash := getHash(al.hashKey, strings.ToLower(email))
+		return slog.String("email_hash", hex.EncodeToString(hash[:sha256.Size/2]))
+	}
+	return slog.String("email", email)
+}
+
+// record writes an event to the audit log, does nothing if the audit log is not enabled
+func (al *auditLog) record(r *http.Request, event string, email string, attrs ...slog.Attr) {
+	if al == nil {
+		return
+	}
+
+	attrs = append(attrs,
+		slog.String("client_ip", clientIP(r)),
+		slog.String("user_agent", r.UserAgent()),
+	)
+
+	if email != "" {
+		attrs = append(attrs, al.emailAttr(email))
+	}
+
+	if requestID := middleware.GetReqID(r.Context()); requestID != "" {
+		attrs = append(attrs, slog.String("request_id", requestID))
+	}
+
+	al.logger.LogAttrs(r.Context(), slog.LevelInfo, event, attrs...)
+}
@@ -2,7 +2,6 @@ package backend
 
 import (
 	"fmt"
-	"log"
 
 	"github.com/cocreators-ee/praga"
 	"github.com/mailjet/mailjet-apiv3-go/v4"
@@ -20,6 +19,8 @@ type MailjetSender struct {
 	from     string
 	fromName string
 	subject  string
+
+	validMinutes int
 }
 
 func getMailjetSender(srv *Server) *MailjetSender {
@@ -28,14 +29,18 @@ func getMailjetSender(srv *Server) *MailjetSender {
 		from:     srv.Config.Email.From,
 		fromName: srv.Config.Email.FromName,
 		subject:  fmt.Sprintf("%s verification code", srv.Config.Brand),
+
+		validMinutes: int(srv.codeFormat().minValidity().Minutes()),
 	}
 }
 
-func (ms MailjetSender) sendEmailViaMailjet(email, brand, code, support string) {
+func (ms MailjetSender) sendEmailViaMailjet(email, brand, code, support string) error {
 	variables := map[string]interface{}{
 		"brand":   brand,
 		"code":    code,
 		"support": support,
+
+		"valid_minutes": ms.validMinutes,
 	}
 
 	messagesInfo := []mailjet.InfoMessagesV31{
@@ -59,8 +64,28 @@ func (ms MailjetSender) sendEmailViaMailjet(email, brand, code, support string)
 
 	messages := mailjet.MessagesV31{Info: messagesInfo}
 	_, err := ms.client.SendMailV31(&messages)
-	if err != nil {
-		log.Fatal(err)
+	return err
+}
+
+// sendTextEmail sends a plain text email, for notifications other than the verification codes
+func (ms MailjetSender) sendTextEmail(email, subject, text string) error {
+	messagesInfo := []mailjet.InfoMessagesV31{
+		{
+			From: &mailjet.RecipientV31{
+				Email: ms.from,
+				Name:  ms.fromName,
+			},
+			To: &mailjet.RecipientsV31{
+				mailjet.RecipientV31{
+					Email: email,
+				},
+			},
+			Subject:  subject,
+			TextPart: text,
+		},
 	}
-	// fmt.Printf("Data: %+v\n", res)
+
+	messages := mailjet.MessagesV31{Info: messagesInfo}
+	_, err := ms.client.SendMailV31(&messages)
+	return err
 }
@@ -0,0 +1,101 @@
+package backend
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Kept separate from the default registry so only our own metrics and the process basics are exposed
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	verifyTokenResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "praga_verify_token_total",
+		Help: "Token verification requests from the proxy by result (valid, missing, invalid, expired, forbidden).",
+	}, []string{"result"})
+
+	authzWebhookResults = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "praga_authz_webhook_total",
+		Help: "Decisions from the authorization webhook by result (allow, deny, error), not counting cached decisions.",
+	}, []string{"result"})
+
+	codesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "praga_codes_sent_total",
+		Help: "Verification codes sent by email provider.",
+	}, []string{"provider"})
+
+	codeSendFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "praga_code_send_failures_total",
+		Help: "Verification codes that failed to send by email provider.",
+	}, []string{"provider"})
+
+	codeVerifyAttempts = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "praga_code_verify_attempts_total",
+		Help: "Attempts to log in with a verification code.",
+	})
+
+	codeVerifySuccesses = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "praga_code_verify_successes_total",
+		Help: "Successful logins with a verification code.",
+	})
+
+	rateLimitHits = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "praga_rate_limit_hits_total",
+		Help: "Requests refused due to rate limits by limit type (ip, email).",
+	}, []string{"limit"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "praga_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		verifyTokenResults,
+		authzWebhookResults,
+		codesSent,
+		codeSendFailures,
+		codeVerifyAttempts,
+		codeVerifySuccesses,
+		rateLimitHits,
+		httpRequestDuration,
+	)
+}
+
+// metricsHandler serves the collected metrics in the Prometheus format
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// measureRequests records the latency of every request by the matched route pattern
+func measureRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		// Use the route pattern to avoid unbounded label values from e.g. static files
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		httpRequestDuration.WithLabelValues(route, r.Method, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/net/idna"
+)
+
+// normalizeDomain converts the domain to lowercase ASCII, with international domains in punycode
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.TrimSpace(domain), ".")
+
+	ascii, err := idna.Lookup.ToASCII(domain)
+	if err != nil {
+		return "", fmt.Errorf("invalid domain %s: %w", domain, err)
+	}
+	return strings.ToLower(ascii), nil
+}
+
+// normalizeEmail converts the email to the form used for allowlist checks, codes and tokens so variations of
+// the same address are treated the same. The local part is lowercased, the domain converted with
+// normalizeDomain, and plus addressing and dots removed for domains configured to ignore them.
+func normalizeEmail(config EmailConfig, email string) (string, error) {
+	email = strings.TrimSpace(email)
+
+	at := strings.LastIndex(email, "@")
+	if at <= 0 || at == len(email)-1 {
+		return "", errors.New("invalid email address")
+	}
+
+	local := strings.ToLower(email[:at])
+	domain, err := normalizeDomain(email[at+1:])
+	if err != nil {
+		return "", err
+	}
+
+	for _, rule := range config.Normalize {
+		ruleDomain, err := normalizeDomain(rule.Domain)
+		if err != nil || ruleDomain != domain {
+			continue
+		}
+
+		if rule.StripPlus {
+			local, _, _ = strings.Cut(local, "+")
+		}
+		if rule.StripDots {
+			local = strings.ReplaceAll(local, ".", "")
+		}
+	}
+
+	if local == "" {
+		return "", errors.New("invalid email address")
+	}
+
+	return local + "@" + domain, nil
+}
+
+// checkEmailConfig ensures all the configured domains, emails and patterns are valid
+func checkEmailConfig(config EmailConfig) error {
+	for _, rule := range config.Normalize {
+		if _, err := normalizeDomain(rule.Domain); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range config.ValidEmails {
+		if err := checkValidity(entry.Email, entry.ValidFrom, entry.ValidUntil); err != nil {
+			return err
+		}
+	}
+
+	for _, group := range config.Groups {
+		if err := checkValidity("group "+group.Name, group.ValidFrom, group.ValidUntil); err != nil {
+			return err
+		}
+		for _, entry := range group.Emails {
+			if err := checkValidity(entry.Email, entry.ValidFrom, entry.ValidUntil); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := newAllowlist(config)
+	return err
+}
+
+// checkValidity ensures an entry limited in time is valid for some time
+func checkValidity(entry string, from time.Time, until time.Time) error {
+	if !from.IsZero() && !until.IsZero() && !until.After(from) {
+		return fmt.Errorf("valid_until of %s is not after its valid_from", entry)
+	}
+	return nil
+}
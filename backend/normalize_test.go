@@ -0,0 +1,86 @@
+package backend
+
+import "testing"
+
+func TestNormalizeEmail(t *testing.T) {
+	config := EmailConfig{
+		Normalize: []EmailNormalizationConfig{
+			{Domain: "Gmail.com", StripPlus: true, StripDots: true},
+			{Domain: "plus.example", StripPlus: true},
+		},
+	}
+
+	tests := map[string]string{
+		"user@example.com":            "user@example.com",
+		" User@Example.COM ":          "user@example.com",
+		"user@example.com.":           "user@example.com",
+		"user@bücher.example":         "user@xn--bcher-kva.example",
+		"User@BÜCHER.example":         "user@xn--bcher-kva.example",
+		"first.last+tag@gmail.com":    "firstlast@gmail.com",
+		"first.last+tag@plus.example": "first.last@plus.example",
+		"first.last+tag@example.com":  "first.last+tag@example.com",
+	}
+
+	for email, expected := range tests {
+		normalized, err := normalizeEmail(config, email)
+		if err != nil {
+			t.Errorf("Error normalizing %s: %s", email, err)
+		} else if normalized != expected {
+			t.Errorf("Normalized %s to %s, expected %s", email, normalized, expected)
+		}
+	}
+
+	for _, email := range []string{"", "user", "@example.com", "user@", "+tag@gmail.com"} {
+		if normalized, err := normalizeEmail(config, email); err == nil {
+			t.Errorf("Invalid email %q was normalized to %s", email, normalized)
+		}
+	}
+}
+
+func TestEmailAllowedNormalized(t *testing.T) {
+	config := EmailConfig{
+		ValidDomains: []string{"Bücher.example"},
+		ValidEmails:  []EmailEntry{{Email: "First.Last+Tag@Gmail.com"}},
+		Normalize:    []EmailNormalizationConfig{{Domain: "gmail.com", StripPlus: true, StripDots: true}},
+	}
+	srv := &Server{Config: Config{Email: config}}
+
+	for _, email := range []string{"User@BÜCHER.example", "firstlast+other@gmail.com", "FIRST.LAST@gmail.com"} {
+		normalized, err := normalizeEmail(config, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !emailAllowed(srv, normalized) {
+			t.Errorf("Email %s was not allowed", email)
+		}
+	}
+
+	if emailAllowed(srv, "other@gmail.com") {
+		t.Error("Email other@gmail.com was allowed")
+	}
+}
+
+func TestCheckEmailConfig(t *testing.T) {
+	valid := EmailConfig{
+		ValidDomains:  []string{"*.corp.example"},
+		AllowPatterns: []string{"ops-?@example.com", "/^[a-z]+@example\\.com$/"},
+		DenyPatterns:  []string{"contractor-*@corp.example"},
+	}
+	if err := checkEmailConfig(valid); err != nil {
+		t.Errorf("Valid configuration failed: %s", err)
+	}
+
+	invalid := []EmailConfig{
+		{ValidDomains: []string{"*.-invalid-"}},
+		{AllowPatterns: []string{"[a-@example.com"}},
+		{AllowPatterns: []string{"[z-a]@example.com"}},
+		{AllowPatterns: []string{"[]@example.com"}},
+		{DenyPatterns: []string{"[a\\"}},
+		{DenyPatterns: []string{"/(unclosed/"}},
+	}
+	for _, config := range invalid {
+		if err := checkEmailConfig(config); err == nil {
+			t.Errorf("Invalid configuration %+v passed", config)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package backend
+
+/*
+ * The access policy is a list of rules written in CEL (https://cel.dev), each of which has to evaluate to true for
+ * a request to /api/verify-token to be allowed, e.g.
+ *
+ *   path == "/health" || ("engineering" in groups && time.getDayOfWeek("Europe/Helsinki") in [1, 2, 3, 4, 5])
+ *
+ * The rules are compiled when the configuration is loaded, so mistakes in them are found before they're used.
+ */
+
+import (
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// PolicyInput is what the access policy rules are evaluated against
+type PolicyInput struct {
+	Email  string    `yaml:"email"`
+	Groups []string  `yaml:"groups"`
+	Host   string    `yaml:"host"`
+	Path   string    `yaml:"path"`
+	Method string    `yaml:"method"`
+	IP     string    `yaml:"ip"`
+	Time   time.Time `yaml:"time"`
+}
+
+// PolicyResult is the outcome of evaluating one of the access policy rules
+type PolicyResult struct {
+	Rule  string
+	Allow bool
+	// Rules failing to evaluate, e.g. due to an invalid CIDR, deny access
+	Err error
+}
+
+type policyRule struct {
+	name    string
+	program cel.Program
+}
+
+// accessPolicy is the compiled access policy
+type accessPolicy struct {
+	rules []policyRule
+}
+
+// inCIDR checks if the IP address is in the CIDR range, e.g. inCIDR(ip, "10.8.0.0/16")
+func inCIDR(ip ref.Val, cidr ref.Val) ref.Val {
+	prefix, err := netip.ParsePrefix(fmt.Sprint(cidr.Value()))
+	if err != nil {
+		return types.NewErr("invalid CIDR %v: %v", cidr.Value(), err)
+	}
+
+	addr, err := netip.ParseAddr(fmt.Sprint(ip.Value()))
+	if err != nil {
+		return types.False
+	}
+	return types.Bool(prefix.Contains(addr.Unmap()))
+}
+
+func newPolicyEnv() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.Variable("email", cel.StringType),
+		cel.Variable("groups", cel.ListType(cel.StringType)),
+		cel.Variable("host", cel.StringType),
+		cel.Variable("path", cel.StringType),
+		cel.Variable("method", cel.StringType),
+		cel.Variable("ip", cel.StringType),
+		cel.Variable("time", cel.TimestampType),
+		cel.Function("inCIDR",
+			cel.Overload("inCIDR_string_string", []*cel.Type{cel.StringType, cel.StringType}, cel.BoolType,
+				cel.BinaryBinding(inCIDR),
+			),
+		),
+	)
+}
+
+// compilePolicy compiles the rules of the access policy
+func compilePolicy(config PolicyConfig) (*accessPolicy, error) {
+	env, err := newPolicyEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &accessPolicy{}
+	for _, rule := range config.Rules {
+		ast, issues := env.Compile(rule.Expression)
+		if issues != nil && issues.Err() != nil {
+			return nil, fmt.Errorf("policy rule %s: %w", rule.Name, issues.Err())
+		}
+
+		if ast.OutputType() != cel.BoolType {
+			return nil, fmt.Errorf("policy rule %s gives %s, not bool", rule.Name, ast.OutputType())
+		}
+
+		program, err := env.Program(ast)
+		if err != nil {
+			return nil, fmt.Errorf("policy rule %s: %w", rule.Name, err)
+		}
+
+		policy.rules = append(policy.rules, policyRule{name: rule.Name, program: program})
+	}
+	return policy, nil
+}
+
+// evaluate evaluates each of the rules against the input
+func (p *accessPolicy) evaluate(input PolicyInput) []PolicyResult {
+	groups := input.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+
+	activation := map[string]interface{}{
+		"email":  input.Email,
+		"groups": groups,
+		"host":   input.Host,
+		"path":   input.Path,
+		"method": input.Method,
+		"ip":     input.IP,
+		"time":   input.Time,
+	}
+
+	var results []PolicyResult
+	for _, rule := range p.rules {
+		result := PolicyResult{Rule: rule.name}
+
+		value, _, err := rule.program.Eval(activation)
+		if err != nil {
+			result.Err = err
+		} else {
+			result.Allow = value == types.True
+		}
+
+		results = append(results, result)
+	}
+	return results
+}
+
+// check decides if the input is allowed, giving the first rule denying it otherwise
+func (p *accessPolicy) check(input PolicyInput) (bool, *PolicyResult) {
+	for _, result := range p.evaluate(input) {
+		if !result.Allow {
+			return false, &result
+		}
+	}
+	return true, nil
+}
+
+// EvaluatePolicy evaluates each of the access policy rules of the configuration against the input
+func EvaluatePolicy(config Config, input PolicyInput) ([]PolicyResult, error) {
+	policy, err := compilePolicy(config.Policy)
+	if err != nil {
+		return nil, err
+	}
+	return policy.evaluate(input), nil
+}
+
+// accessPolicy gets the compiled access policy of the current configuration
+func (s *Server) accessPolicy() *accessPolicy {
+	s.policyLock.Lock()
+	defer s.policyLock.Unlock()
+
+	if s.policy == nil {
+		policy, err := compilePolicy(s.Config.Policy)
+		if err != nil {
+			// The policy is compiled when the configuration is validated so this should never happen
+			panic(err)
+		}
+		s.policy = policy
+	}
+	return s.policy
+}
+
+// policyGroups finds the groups of the email for the access policy, from the configuration, the dynamic allowlist
+// and the authorization webhook
+func policyGroups(srv *Server, email string, webhookGroups []string, now time.Time) []string {
+	groups := srv.emailAllowlist().groupsOf(email, now)
+
+	grant, err := dynamicAccess(srv, email)
+	if err != nil {
+		slog.Error("Error checking dynamic allowlist", slog.String("email", email), slog.Any("error", err))
+	} else if grant != nil && grantActive(srv, grant, now) {
+		groups = append(groups, grant.Groups...)
+	}
+
+	groups = append(groups, webhookGroups...)
+	slices.Sort(groups)
+	return slices.Compact(groups)
+}
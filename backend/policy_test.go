@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCompilePolicy(t *testing.T) {
+	invalid := map[string]string{
+		"syntax":    `email ==`,
+		"undefined": `user == "someone"`,
+		"not bool":  `groups.size()`,
+	}
+
+	for name, expression := range invalid {
+		if _, err := compilePolicy(PolicyConfig{Rules: []PolicyRuleConfig{{Name: name, Expression: expression}}}); err == nil {
+			t.Errorf("Compiling %s rule %q did not fail", name, expression)
+		}
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, err := compilePolicy(PolicyConfig{Rules: []PolicyRuleConfig{
+		{Name: "engineering", Expression: `path == "/health" || ("engineering" in groups && time.getDayOfWeek("UTC") in [1, 2, 3, 4, 5])`},
+		{Name: "vpn", Expression: `path == "/health" || inCIDR(ip, "10.8.0.0/16") || inCIDR(ip, "fd00::/8")`},
+		{Name: "read only", Expression: `method in ["GET", "HEAD"] || email.endsWith("@admin.example.com")`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	monday := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	sunday := time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+	engineer := PolicyInput{Email: "dev@example.com", Groups: []string{"engineering"}, Path: "/app", Method: "GET", IP: "10.8.1.2", Time: monday}
+
+	tests := []struct {
+		name   string
+		change func(input *PolicyInput)
+		denied string
+	}{
+		{"allowed", func(input *PolicyInput) {}, ""},
+		{"IPv6", func(input *PolicyInput) { input.IP = "fd00::1" }, ""},
+		{"weekend", func(input *PolicyInput) { input.Time = sunday }, "engineering"},
+		{"other group", func(input *PolicyInput) { input.Groups = []string{"sales"} }, "engineering"},
+		{"outside VPN", func(input *PolicyInput) { input.IP = "192.0.2.1" }, "vpn"},
+		{"invalid IP", func(input *PolicyInput) { input.IP = "" }, "vpn"},
+		{"write", func(input *PolicyInput) { input.Method = "POST" }, "read only"},
+		{"health", func(input *PolicyInput) { *input = PolicyInput{Path: "/health", Method: "GET", Time: sunday} }, ""},
+	}
+
+	for _, test := range tests {
+		input := engineer
+		test.change(&input)
+
+		allowed, result := policy.check(input)
+		if test.denied == "" && !allowed {
+			t.Errorf("%s was denied by %+v", test.name, result)
+		}
+		if test.denied != "" && (allowed || result.Rule != test.denied) {
+			t.Errorf("%s was not denied by %s, got %+v", test.name, test.denied, result)
+		}
+	}
+
+	// Rules that fail to evaluate deny access
+	policy, err = compilePolicy(PolicyConfig{Rules: []PolicyRuleConfig{{Name: "typo", Expression: `inCIDR(ip, "10.8.0.0/99")`}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, result := policy.check(engineer); allowed || result.Err == nil {
+		t.Errorf("Rule failing to evaluate gave %+v", result)
+	}
+}
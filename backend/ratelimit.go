@@ -0,0 +1,39 @@
+package backend
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter counts requests per key within hourly windows
+type rateLimiter struct {
+	lock        sync.Mutex
+	windowStart time.Time
+	counts      map[string]int
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		counts: map[string]int{},
+	}
+}
+
+// allow counts a request for the key and tells if it's still within perHour, 0 disables the limit
+func (rl *rateLimiter) allow(key string, perHour int, now time.Time) bool {
+	if perHour <= 0 {
+		return true
+	}
+
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	// Start a new window every hour, which also keeps the map from growing forever
+	window := now.Truncate(time.Hour)
+	if !window.Equal(rl.windowStart) {
+		rl.windowStart = window
+		rl.counts = map[string]int{}
+	}
+
+	rl.counts[key]++
+	return rl.counts[key] <= perHour
+}
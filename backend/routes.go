@@ -1,12 +1,16 @@
 package backend
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
 	"reflect"
+	"slices"
 	"strings"
 	"time"
 
@@ -45,85 +49,345 @@ func clearAuthCookie(srv *Server, w http.ResponseWriter) {
 	http.SetCookie(w, cookie)
 }
 
-func makeAuthCookie(srv *Server, email string) *http.Cookie {
-	token, err := MakeToken(srv, email)
+func makeAuthCookie(srv *Server, email string, audience ...string) *http.Cookie {
+	token, expires, err := issueToken(srv, email, newTokenSession(audience))
 	if err != nil {
-		if debug {
-			log.Printf("Error making token: %s\n", err)
-		}
+		slog.Error("Error making token", slog.Any("error", err))
 		return nil
 	}
 
+	return newTokenCookie(srv, token, expires)
+}
+
+// newTokenCookie creates the authentication cookie for the token
+func newTokenCookie(srv *Server, token string, expires time.Time) *http.Cookie {
 	cookie := newAuthCookie(srv)
 	cookie.Value = token
-	cookie.Expires = time.Now().Add(time.Duration(srv.Config.JWT.ValidSeconds) * time.Second)
+	cookie.Expires = expires
 	return cookie
 }
 
-func setAuthCookie(srv *Server, email string, w http.ResponseWriter) {
-	cookie := makeAuthCookie(srv, email)
-	if cookie != nil {
-		http.SetCookie(w, cookie)
+// setAuthCookie logs the user in with a new session
+func setAuthCookie(srv *Server, w http.ResponseWriter, r *http.Request, email string, audience ...string) error {
+	session := newTokenSession(audience)
+	session.binding = newClientBinding(srv, r)
+	token, expires, err := issueToken(srv, email, session)
+	if err != nil {
+		return fmt.Errorf("error making token: %w", err)
+	}
+
+	if err := registerSession(srv, r, email, session, expires); err != nil {
+		return fmt.Errorf("error registering session: %w", err)
 	}
+
+	http.SetCookie(w, newTokenCookie(srv, token, expires))
+	return nil
 }
 
-func validateToken(srv *Server, token string) bool {
-	_, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		// Ensure signing method is correct
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
+// tokenClaims are the claims in the authentication tokens
+type tokenClaims struct {
+	jwt.RegisteredClaims
 
-		return []byte(srv.Config.SigningKey), nil
-	})
+	// When the user logged in, kept when refreshing tokens to limit the total length of the session
+	AuthTime *jwt.NumericDate `json:"auth_time,omitempty"`
+
+	// Keyed hashes of the client IP prefix and user agent when tokens are bound to the client
+	IPHash        string `json:"iph,omitempty"`
+	UserAgentHash string `json:"uah,omitempty"`
+}
+
+// tokenSession describes the login session a token is issued for
+type tokenSession struct {
+	id       string
+	audience []string
+	authTime time.Time
+	binding  clientBinding
+}
+
+// newTokenSession starts a new login session
+func newTokenSession(audience []string) tokenSession {
+	return tokenSession{
+		id:       uuid.New().String(),
+		audience: audience,
+		authTime: time.Now(),
+	}
+}
+
+// sessionFromClaims continues the login session of an existing token
+func sessionFromClaims(claims *tokenClaims) tokenSession {
+	session := tokenSession{
+		id:       claims.ID,
+		audience: claims.Audience,
+		binding:  clientBinding{ipHash: claims.IPHash, uaHash: claims.UserAgentHash},
+	}
+
+	// Tokens from before auth_time was added started their session when issued
+	if claims.AuthTime != nil {
+		session.authTime = claims.AuthTime.Time
+	} else if claims.IssuedAt != nil {
+		session.authTime = claims.IssuedAt.Time
+	}
+
+	return session
+}
+
+// maxSessionEnd is when the session must end at the latest, zero if the session length is not limited
+func maxSessionEnd(srv *Server, session tokenSession) time.Time {
+	if srv.Config.JWT.MaxSessionSeconds == 0 {
+		return time.Time{}
+	}
+	return session.authTime.Add(time.Duration(srv.Config.JWT.MaxSessionSeconds) * time.Second)
+}
+
+func validateToken(srv *Server, token string, options ...jwt.ParserOption) (*tokenClaims, error) {
+	options = append(options,
+		jwt.WithLeeway(time.Duration(srv.Config.JWT.LeewaySeconds)*time.Second),
+		jwt.WithIssuedAt(),
+	)
+
+	if srv.Config.JWT.Issuer != "" {
+		options = append(options, jwt.WithIssuer(srv.Config.JWT.Issuer))
+	}
+
+	// Plain tokens are still accepted with jwt.encrypt so existing sessions continue after enabling it
+	token, err := srv.signingKeys().openToken(token)
 	if err != nil {
-		if debug {
-			log.Printf("Token validation failed: %s\n", err)
-		}
-		return false
+		return nil, err
 	}
 
-	return true
+	claims := &tokenClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, srv.signingKeys().tokenKeyFunc, options...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The maximum session length could have been lowered after the token was issued
+	end := maxSessionEnd(srv, sessionFromClaims(claims))
+	if !end.IsZero() && time.Now().After(end.Add(time.Duration(srv.Config.JWT.LeewaySeconds)*time.Second)) {
+		return nil, fmt.Errorf("%w: maximum session length exceeded", jwt.ErrTokenExpired)
+	}
+
+	return claims, nil
+}
+
+// MakeToken creates a new signed authentication token for the email, valid for the given audiences
+func MakeToken(srv *Server, email string, audience ...string) (string, error) {
+	token, _, err := issueToken(srv, email, newTokenSession(audience))
+	return token, err
 }
 
-func MakeToken(srv *Server, email string) (string, error) {
+// issueToken creates a signed authentication token for the session, also returning when it expires
+func issueToken(srv *Server, email string, session tokenSession) (string, time.Time, error) {
 	expireDuration := time.Duration(srv.Config.JWT.ValidSeconds) * time.Second
+	now := time.Now()
 
-	claims := &jwt.RegisteredClaims{
-		Subject:   email,
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(expireDuration)),
-		ID:        uuid.New().String(),
+	expires := now.Add(expireDuration)
+	if end := maxSessionEnd(srv, session); !end.IsZero() && end.Before(expires) {
+		expires = end
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(srv.Config.SigningKey))
+	claims := &tokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    srv.Config.JWT.Issuer,
+			Subject:   email,
+			Audience:  session.audience,
+			ExpiresAt: jwt.NewNumericDate(expires),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        session.id,
+		},
+		AuthTime:      jwt.NewNumericDate(session.authTime),
+		IPHash:        session.binding.ipHash,
+		UserAgentHash: session.binding.uaHash,
+	}
+
+	keys := srv.signingKeys()
+	token := jwt.NewWithClaims(keys.method, claims)
+	token.Header["kid"] = keys.active.id
+	tokenString, err := token.SignedString(keys.active.signingKey())
 	if err != nil {
-		if debug {
-			log.Printf("Failed to sign token: %s\n", err)
+		slog.Debug("Failed to sign token", slog.Any("error", err))
+		return "", time.Time{}, err
+	}
+
+	if srv.Config.JWT.Encrypt {
+		tokenString, err = keys.sealToken(tokenString)
+		if err != nil {
+			return "", time.Time{}, fmt.Errorf("error encrypting token: %w", err)
 		}
-		return "", err
 	}
-	return tokenString, nil
+	return tokenString, expires, nil
 }
 
-func sendCode(srv *Server, email string, code string) {
-	if debug {
-		log.Printf("New code for %s: %s", email, code)
+// refreshToken issues a fresh token for sliding sessions once the current one is old enough, the cookie is
+// passed on to the browser by Nginx from the /api/verify-token response
+func refreshToken(srv *Server, w http.ResponseWriter, r *http.Request, claims *tokenClaims) {
+	refreshAfter := time.Duration(srv.Config.JWT.RefreshAfterSeconds) * time.Second
+	if refreshAfter == 0 || claims.IssuedAt == nil || time.Since(claims.IssuedAt.Time) < refreshAfter {
+		return
+	}
+
+	session := sessionFromClaims(claims)
+	if end := maxSessionEnd(srv, session); !end.IsZero() && time.Until(end) <= 0 {
+		return
 	}
 
+	token, expires, err := issueToken(srv, claims.Subject, session)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error refreshing token", slog.Any("error", err))
+		return
+	}
+
+	if err := extendSession(srv, session.id, expires); err != nil {
+		slog.ErrorContext(r.Context(), "Error extending session", slog.Any("error", err))
+		return
+	}
+
+	slog.DebugContext(r.Context(), "Refreshed token", slog.String("jti", session.id))
+	http.SetCookie(w, newTokenCookie(srv, token, expires))
+}
+
+// checkVerifyCodeAnyKey checks the code against all the keys still in use, so rotating keys does not break
+// codes that were just sent
+func checkVerifyCodeAnyKey(srv *Server, code string, email string) bool {
+	format := srv.codeFormat()
+	for _, key := range srv.signingKeys().verificationKeys() {
+		if format.verify(code, key.codeKey, email, time.Now()) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactCode hides the code from logs unless running in development mode
+func redactCode(srv *Server, code string) string {
+	if srv.Config.DevMode {
+		return code
+	}
+	return "[redacted]"
+}
+
+// skipSending checks if emails should not actually be sent to the address, for example.com and its subdomains
+// e.g. in tests
+func skipSending(email string) bool {
+	domain := strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+	return domain == "example.com" || strings.HasSuffix(domain, ".example.com")
+}
+
+func sendCode(ctx context.Context, srv *Server, email string, code string) {
+	slog.DebugContext(ctx, "New code", slog.String("email", email), slog.String("code", redactCode(srv, code)))
+
 	testLastSentCode = code
 
-	// Skip @example.com - e.g. for tests
-	if strings.HasSuffix(email, "@example.com") {
+	if skipSending(email) {
 		return
 	}
 
-	if srv.Config.Email.EmailProvider == "mailjet" {
-		srv.MailjetSender.sendEmailViaMailjet(email, srv.Config.Brand, code, srv.Config.Support)
+	provider := srv.Config.Email.EmailProvider
+	var err error
+	if provider == "mailjet" {
+		err = srv.MailjetSender.sendEmailViaMailjet(email, srv.Config.Brand, code, srv.Config.Support)
+	}
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to send code", slog.String("provider", provider), slog.Any("error", err))
+		codeSendFailures.WithLabelValues(provider).Inc()
+		return
 	}
+
+	codesSent.WithLabelValues(provider).Inc()
 }
 
-func validateRequest(payload interface{}) bool {
+// clientIPKey is the request context key for the address of the client
+type clientIPKey struct{}
+
+// clientIP gets the address of the client, as worked out by resolveClientIP
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPKey{}).(string); ok {
+		return ip
+	}
+	return remoteIP(r, nil)
+}
+
+// remoteIP gets the address of the client, preferring the one forwarded in X-Real-IP by a trusted proxy. Connections
+// to unix sockets have no address and can only be made by local processes like Nginx, so they are trusted.
+func remoteIP(r *http.Request, trusted []netip.Prefix) string {
+	realIP := r.Header.Get("X-Real-IP")
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		if realIP != "" {
+			return realIP
+		}
+		return r.RemoteAddr
+	}
+
+	addr, err := netip.ParseAddr(host)
+	if err == nil && realIP != "" && slices.ContainsFunc(trusted, func(prefix netip.Prefix) bool { return prefix.Contains(addr.Unmap()) }) {
+		return realIP
+	}
+	return host
+}
+
+// resolveClientIP works out the address of the client for the rest of the request, only believing X-Real-IP from
+// server.trusted_proxies as anyone else could set it to anything
+func (s *Server) resolveClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := remoteIP(r, s.trustedProxies())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// trustedProxies gets the parsed server.trusted_proxies, which like the rest of the server configuration only
+// changes on restart
+func (s *Server) trustedProxies() []netip.Prefix {
+	s.proxiesLock.Lock()
+	defer s.proxiesLock.Unlock()
+
+	if s.proxies != nil {
+		return s.proxies
+	}
+
+	// Requests only lock the configuration after the client address is known
+	s.configLock.RLock()
+	defer s.configLock.RUnlock()
+
+	s.proxies = []netip.Prefix{}
+	for _, proxy := range s.Config.Server.TrustedProxies {
+		prefix, err := netip.ParsePrefix(proxy)
+		if err != nil {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(proxy)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if err != nil {
+			// The configuration is validated when loaded so this should never happen
+			panic(err)
+		}
+		s.proxies = append(s.proxies, prefix.Masked())
+	}
+	return s.proxies
+}
+
+// rateLimited checks the configured rate limits for the request, reporting failure when exceeded
+func rateLimited(srv *Server, w http.ResponseWriter, r *http.Request, limiter *rateLimiter, limit string, key string) bool {
+	perHour := srv.Config.Auth.RateLimit.IP.PerHour
+	if limit == "email" {
+		perHour = srv.Config.Auth.RateLimit.Email.PerHour
+	}
+
+	if limiter.allow(key, perHour, time.Now()) {
+		return false
+	}
+
+	slog.WarnContext(r.Context(), "Rate limit hit", slog.String("limit", limit), slog.String("key", key))
+
+	rateLimitHits.WithLabelValues(limit).Inc()
+	w.WriteHeader(http.StatusTooManyRequests)
+	return true
+}
+
+func validateRequest(ctx context.Context, payload interface{}) bool {
 	validate := validator.New()
 	validate.RegisterTagNameFunc(func(fld reflect.StructField) string {
 		name := strings.SplitN(fld.Tag.Get("json"), ",", 2)[0]
@@ -135,14 +399,12 @@ func validateRequest(payload interface{}) bool {
 
 	if err := validate.Struct(payload); err != nil {
 		var validationErrors validator.ValidationErrors
-		if debug {
-			if errors.As(err, &validationErrors) {
-				for _, verr := range validationErrors {
-					log.Print(strings.Replace(verr.Error(), "Config.", "", 1))
-				}
-			} else {
-				log.Print(err)
+		if errors.As(err, &validationErrors) {
+			for _, verr := range validationErrors {
+				slog.DebugContext(ctx, "Invalid request", slog.String("error", strings.Replace(verr.Error(), "Config.", "", 1)))
 			}
+		} else {
+			slog.DebugContext(ctx, "Invalid request", slog.Any("error", err))
 		}
 		return false
 	}
@@ -151,12 +413,27 @@ func validateRequest(payload interface{}) bool {
 }
 
 func registerRoutes(srv *Server, r *chi.Mux) {
+	ipLimiter := newRateLimiter()
+	emailLimiter := newRateLimiter()
+	// Verification attempts have their own budget, so mistyping a code does not prevent requesting a new one
+	verifyLimiter := newRateLimiter()
+
+	if srv.Config.Metrics.Enabled {
+		r.Method("GET", "/metrics", metricsHandler())
+	}
+
 	// Get relevant configuration for frontend
 	r.Get("/api/config", func(w http.ResponseWriter, r *http.Request) {
 		err := json.NewEncoder(w).Encode(configResponse{
-			Title:   srv.Config.Title,
-			Brand:   srv.Config.Brand,
-			Support: srv.Config.Support,
+			Title:    srv.Config.Title,
+			Brand:    srv.Config.Brand,
+			Support:  srv.Config.Support,
+			Sessions: srv.Config.Sessions.Registry,
+			Code: codeFormatResponse{
+				Alphabet: srv.codeFormat().alphabet,
+				Length:   srv.codeFormat().length,
+			},
+			AccessRequests: srv.Config.AccessRequests.Enabled,
 		})
 
 		if err != nil {
@@ -166,31 +443,128 @@ func registerRoutes(srv *Server, r *chi.Mux) {
 		}
 	})
 
+	// Public keys for services to verify tokens themselves, empty for HS256 as the key must stay secret
+	r.Get("/.well-known/jwks.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(srv.signingKeys().jwks()); err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+		}
+	})
+
 	// Verify token from Nginx requests
 	r.Get("/api/verify-token", func(w http.ResponseWriter, r *http.Request) {
 		token, err := r.Cookie(srv.Config.CookieAuth.CookieName)
 		if err != nil {
 			// Failed to read cookie
-			if debug {
-				if errors.Is(err, http.ErrNoCookie) {
-					log.Printf("Verify request missing cookies %s\n", srv.Config.CookieAuth.CookieName)
-				} else {
-					log.Printf("Error getting cookie %s\n", err)
-				}
+			if errors.Is(err, http.ErrNoCookie) {
+				slog.DebugContext(r.Context(), "Verify request missing cookie", slog.String("cookie", srv.Config.CookieAuth.CookieName))
+			} else {
+				slog.DebugContext(r.Context(), "Error getting cookie", slog.Any("error", err))
 			}
 
+			verifyTokenResults.WithLabelValues("missing").Inc()
 			authFailed(w)
 			return
 		}
 
-		if !validateToken(srv, token.Value) {
+		// With sites configured the token must be meant for the site being accessed
+		var options []jwt.ParserOption
+		if len(srv.Config.Sites) > 0 {
+			audience, ok := siteAudience(srv, originalHost(r))
+			if !ok {
+				slog.DebugContext(r.Context(), "Verify request for unknown site", slog.String("host", originalHost(r)))
+				verifyTokenResults.WithLabelValues("invalid").Inc()
+				authFailed(w)
+				return
+			}
+			options = append(options, jwt.WithAudience(audience))
+		}
+
+		claims, err := validateToken(srv, token.Value, options...)
+		if err == nil {
+			err = checkClientBinding(srv, r, claims)
+		}
+		if err == nil {
+			err = checkSession(srv, claims)
+		}
+		if err == nil {
+			err = checkAccess(srv, claims)
+		}
+		if err != nil {
 			// Token validation failed - clear and report error
+			slog.DebugContext(r.Context(), "Token validation failed", slog.Any("error", err))
+			srv.audit.record(r, auditTokenRejected, "", slog.String("reason", err.Error()))
+
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				verifyTokenResults.WithLabelValues("expired").Inc()
+			} else {
+				verifyTokenResults.WithLabelValues("invalid").Inc()
+			}
+
 			clearAuthCookie(srv, w)
 			authFailed(w)
 			return
 		}
 
-		// Token validated successfully, report success
+		// The token stays valid, the webhook may e.g. only deny some sites. Nginx has to set the original path,
+		// otherwise the client could pick the one to check.
+		var groups []string
+		if srv.Config.AuthzWebhook.VerifyToken {
+			path, ok := originalPath(r)
+			if !ok {
+				slog.WarnContext(r.Context(), "X-Original-URI is not set, denying access")
+				verifyTokenResults.WithLabelValues("forbidden").Inc()
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			decision := authorized(r.Context(), srv, authzRequest{Email: claims.Subject, Host: originalHost(r), Path: path})
+			if !decision.Allow {
+				slog.DebugContext(r.Context(), "Authorization webhook denied access", slog.String("email", claims.Subject))
+				srv.audit.record(r, auditTokenRejected, claims.Subject, slog.String("reason", "authorization webhook denied access"))
+				verifyTokenResults.WithLabelValues("forbidden").Inc()
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			groups = decision.Groups
+		}
+
+		if len(srv.Config.Policy.Rules) > 0 {
+			path, pathOk := originalPath(r)
+			method, methodOk := originalMethod(r)
+			if !pathOk || !methodOk {
+				slog.WarnContext(r.Context(), "X-Original-URI or X-Original-Method is not set, denying access")
+				verifyTokenResults.WithLabelValues("forbidden").Inc()
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			input := PolicyInput{
+				Email:  claims.Subject,
+				Host:   originalHost(r),
+				Path:   path,
+				Method: method,
+				IP:     clientIP(r),
+				Time:   time.Now(),
+			}
+			input.Groups = policyGroups(srv, input.Email, groups, input.Time)
+
+			if allowed, result := srv.accessPolicy().check(input); !allowed {
+				slog.DebugContext(r.Context(), "Access policy denied access", slog.String("email", claims.Subject), slog.String("rule", result.Rule), slog.Any("error", result.Err))
+				srv.audit.record(r, auditTokenRejected, claims.Subject, slog.String("reason", "access policy rule "+result.Rule+" denied access"))
+				verifyTokenResults.WithLabelValues("forbidden").Inc()
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+		}
+
+		// Token validated successfully, report success with the identity for Nginx to pass on to upstreams
+		verifyTokenResults.WithLabelValues("valid").Inc()
+		w.Header().Set("X-Praga-Email", claims.Subject)
+		if len(groups) > 0 {
+			w.Header().Set("X-Praga-Groups", strings.Join(groups, ","))
+		}
+		refreshToken(srv, w, r, claims)
 		w.WriteHeader(204)
 	})
 
@@ -208,37 +582,47 @@ func registerRoutes(srv *Server, r *chi.Mux) {
 			return
 		}
 
-		if !validateRequest(req) {
+		if !validateRequest(r.Context(), req) {
 			w.WriteHeader(400)
 			return
 		}
 
-		// Check if the given email is valid
-		validEmail := false
-		for _, domain := range srv.Config.Email.ValidDomains {
-			if strings.HasSuffix(req.Email, "@"+domain) {
-				validEmail = true
-				break
-			}
+		// Variations of the same address are treated the same, the code is still sent to the address as given
+		email, err := normalizeEmail(srv.Config.Email, req.Email)
+		if err != nil {
+			slog.DebugContext(r.Context(), "Invalid email", slog.String("email", req.Email), slog.Any("error", err))
+			w.WriteHeader(400)
+			return
 		}
 
-		if !validEmail {
-			for _, email := range srv.Config.Email.ValidEmails {
-				if req.Email == email {
-					validEmail = true
-					break
-				}
-			}
+		if rateLimited(srv, w, r, ipLimiter, "ip", clientIP(r)) || rateLimited(srv, w, r, emailLimiter, "email", email) {
+			return
+		}
+
+		// Blocked domains are checked first and counted, e.g. to notice abuse by throwaway email providers
+		if blocked, rule := srv.emailAllowlist().blockedDomain(email); blocked {
+			slog.DebugContext(r.Context(), "Email domain is blocked", slog.String("email", email), slog.String("rule", rule))
+			srv.audit.record(r, auditCodeBlocked, email, slog.String("rule", rule), slog.Int("attempts", srv.countBlockedAttempt(rule)))
+			w.WriteHeader(204)
+			return
 		}
 
+		// Check if the given email is valid
+		validEmail := mayLogIn(r.Context(), srv, email, req.Target)
+
+		srv.audit.record(r, auditCodeRequested, email, slog.Bool("allowed", validEmail))
+
 		// Only send if the email is valid
 		if validEmail {
-			code := MakeVerifyCodeNow(srv.Config.SigningKey, req.Email)
-			sendCode(srv, req.Email, code)
-		} else {
-			if debug {
-				log.Printf("%s is not allowed to log in", req.Email)
+			code, err := issueCode(srv, email)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error issuing code", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
 			}
+			sendCode(r.Context(), srv, strings.TrimSpace(req.Email), code)
+		} else {
+			slog.DebugContext(r.Context(), "Email is not allowed to log in", slog.String("email", email))
 		}
 
 		// Always report success, we don't want to expose if the email is valid or not
@@ -259,16 +643,77 @@ func registerRoutes(srv *Server, r *chi.Mux) {
 			return
 		}
 
-		if !validateRequest(req) {
+		if !validateRequest(r.Context(), req) {
+			w.WriteHeader(400)
+			return
+		}
+
+		email, err := normalizeEmail(srv.Config.Email, req.Email)
+		if err != nil {
+			slog.DebugContext(r.Context(), "Invalid email", slog.String("email", req.Email), slog.Any("error", err))
 			w.WriteHeader(400)
 			return
 		}
 
-		if CheckVerifyCode(req.Code, srv.Config.SigningKey, req.Email) {
-			setAuthCookie(srv, req.Email, w)
+		// Limit guessing codes
+		if rateLimited(srv, w, r, verifyLimiter, "ip", clientIP(r)) {
+			return
+		}
+
+		codeVerifyAttempts.Inc()
+
+		// Codes not in the configured format can't be right
+		if !srv.codeFormat().valid(req.Code) {
+			slog.DebugContext(r.Context(), "Invalid code format", slog.String("email", email))
+			srv.audit.record(r, auditLoginFailed, email, slog.String("reason", "invalid code format"))
+			w.WriteHeader(400)
+			return
+		}
+
+		valid, err := checkCode(srv, req.Code, email)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error checking code", slog.Any("error", err))
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+
+		// Access may have expired or been denied by the authorization webhook since the code was sent
+		if valid && !mayLogIn(r.Context(), srv, email, req.Target) {
+			slog.DebugContext(r.Context(), "Email is no longer allowed to log in", slog.String("email", email))
+			srv.audit.record(r, auditLoginFailed, email, slog.String("reason", "email not allowed"))
+			w.WriteHeader(400)
+			return
+		}
+
+		if valid {
+			codeVerifySuccesses.Inc()
+			srv.audit.record(r, auditCodeVerified, email)
+			if err := setAuthCookie(srv, w, r, email, tokenAudiences(srv, r, email, req.Target)...); err != nil {
+				slog.ErrorContext(r.Context(), "Error logging in", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
 			w.WriteHeader(204)
 		} else {
+			srv.audit.record(r, auditLoginFailed, email)
 			w.WriteHeader(400)
 		}
 	})
+
+	// Log out by clearing the cookie
+	r.Post("/api/logout", func(w http.ResponseWriter, r *http.Request) {
+		email := ""
+		if token, err := r.Cookie(srv.Config.CookieAuth.CookieName); err == nil {
+			if claims, err := validateToken(srv, token.Value); err == nil {
+				email = claims.Subject
+				if err := revokeSession(srv, claims.ID); err != nil {
+					slog.ErrorContext(r.Context(), "Error revoking session", slog.Any("error", err))
+				}
+			}
+		}
+
+		srv.audit.record(r, auditLogout, email)
+		clearAuthCookie(srv, w)
+		w.WriteHeader(204)
+	})
 }
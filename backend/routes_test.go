@@ -2,14 +2,23 @@ package backend
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
 )
 
 var (
@@ -41,7 +50,7 @@ func getTestConfig() Config {
 		Email: EmailConfig{
 			EmailProvider: "mailjet",
 			ValidDomains:  []string{"example.com"},
-			ValidEmails:   []string{},
+			ValidEmails:   []EmailEntry{},
 			From:          "auth@example.com",
 			FromName:      "Example Auth",
 		},
@@ -92,7 +101,7 @@ func TestRouteEmailVerifyOk(t *testing.T) {
 	email := "user@example.com"
 	err := json.NewEncoder(buffer).Encode(emailVerifyRequest{
 		Email: email,
-		Code:  MakeVerifyCodeNow(testServer.Config.SigningKey, email),
+		Code:  MakeVerifyCodeNow(testServer.signingKeys().active.codeKey, email),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -122,7 +131,7 @@ func TestRouteEmailVerifyPrevious(t *testing.T) {
 	email := "user@example.com"
 	err := json.NewEncoder(buffer).Encode(emailVerifyRequest{
 		Email: email,
-		Code:  MakeVerifyCodeTS(testServer.Config.SigningKey, email, time.Now().Add(-timeChunks)),
+		Code:  MakeVerifyCodeTS(testServer.signingKeys().active.codeKey, email, time.Now().Add(-timeChunks)),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -148,7 +157,7 @@ func TestRouteEmailVerifyExpired(t *testing.T) {
 	email := "user@example.com"
 	err := json.NewEncoder(buffer).Encode(emailVerifyRequest{
 		Email: email,
-		Code:  MakeVerifyCodeTS(testServer.Config.SigningKey, email, time.Now().Add(-timeChunks*2)),
+		Code:  MakeVerifyCodeTS(testServer.signingKeys().active.codeKey, email, time.Now().Add(-timeChunks*2)),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -174,7 +183,7 @@ func TestRouteEmailVerifyUpcoming(t *testing.T) {
 	email := "user@example.com"
 	err := json.NewEncoder(buffer).Encode(emailVerifyRequest{
 		Email: email,
-		Code:  MakeVerifyCodeTS(testServer.Config.SigningKey, email, time.Now().Add(timeChunks)),
+		Code:  MakeVerifyCodeTS(testServer.signingKeys().active.codeKey, email, time.Now().Add(timeChunks)),
 	})
 	if err != nil {
 		t.Fatal(err)
@@ -292,3 +301,1445 @@ func TestRouteVerifyTokenOk(t *testing.T) {
 		t.Errorf("/api/verify-token returned status %d, expected %d", recorder.Result().StatusCode, expectedStatus)
 	}
 }
+
+func TestRouteMetrics(t *testing.T) {
+	metricsConfig := getTestConfig()
+	metricsConfig.Metrics.Enabled = true
+	metricsServer := &Server{Config: metricsConfig}
+	router := metricsServer.getRouter()
+
+	req, err := http.NewRequest("GET", "/api/verify-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	expectedStatus := 200
+
+	if recorder.Result().StatusCode != expectedStatus {
+		t.Errorf("/metrics returned status %d, expected %d", recorder.Result().StatusCode, expectedStatus)
+	}
+
+	body := recorder.Body.String()
+	for _, metric := range []string{`praga_verify_token_total{result="missing"}`, `praga_http_request_duration_seconds_count{method="GET",route="/api/verify-token",status="401"}`} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("/metrics did not contain %s", metric)
+		}
+	}
+
+	// Disabled by default
+	req, err = http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder = httptest.NewRecorder()
+	testRouter.ServeHTTP(recorder, req)
+	if recorder.Result().StatusCode == 200 && strings.Contains(recorder.Body.String(), "praga_") {
+		t.Error("/metrics was served without being enabled")
+	}
+}
+
+func TestRouteEmailSendRateLimit(t *testing.T) {
+	limitedConfig := getTestConfig()
+	limitedConfig.Auth.RateLimit.Email.PerHour = 2
+	limitedServer := &Server{Config: limitedConfig}
+	router := limitedServer.getRouter()
+
+	statuses := []int{204, 204, 429}
+	for _, expectedStatus := range statuses {
+		buffer := bytes.NewBuffer([]byte{})
+		err := json.NewEncoder(buffer).Encode(emailSendRequest{
+			Email: "limited@example.com",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/email/send", buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+
+		if recorder.Result().StatusCode != expectedStatus {
+			t.Errorf("/api/email/send returned status %d, expected %d", recorder.Result().StatusCode, expectedStatus)
+		}
+	}
+}
+
+func TestRouteEmailVerifyRateLimit(t *testing.T) {
+	limitedConfig := getTestConfig()
+	limitedConfig.Auth.RateLimit.IP.PerHour = 2
+	limitedServer := &Server{Config: limitedConfig}
+	router := limitedServer.getRouter()
+
+	statuses := []int{400, 400, 429}
+	for _, expectedStatus := range statuses {
+		result := postForTest(t, router, "/api/email/verify", emailVerifyRequest{Email: "user@example.com", Code: "ABCD1234"})
+		if result.StatusCode != expectedStatus {
+			t.Errorf("/api/email/verify returned status %d, expected %d", result.StatusCode, expectedStatus)
+		}
+	}
+
+	// Mistyped codes do not use up the limit for requesting new ones
+	if result := postForTest(t, router, "/api/email/send", emailSendRequest{Email: "user@example.com"}); result.StatusCode != 204 {
+		t.Errorf("/api/email/send returned status %d after failed verification attempts, expected 204", result.StatusCode)
+	}
+}
+
+func TestRouteAuditLog(t *testing.T) {
+	auditConfig := getTestConfig()
+	auditConfig.Log.Audit = AuditConfig{
+		Path:       filepath.Join(t.TempDir(), "audit.log"),
+		HashEmails: true,
+		HashKey:    "audit-hash-key-1234567890",
+	}
+
+	audit, err := newAuditLog(auditConfig.Log.Audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	auditServer := &Server{Config: auditConfig, audit: audit}
+	router := auditServer.getRouter()
+
+	buffer := bytes.NewBuffer([]byte{})
+	err = json.NewEncoder(buffer).Encode(emailVerifyRequest{
+		Email: "user@example.com",
+		Code:  "abcd1234",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/email/verify", buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Request-Id", "test-request")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	contents, err := os.ReadFile(auditConfig.Log.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(contents, &entry); err != nil {
+		t.Fatal(err)
+	}
+
+	if entry["msg"] != auditLoginFailed {
+		t.Errorf("Audit event %v, expected %s", entry["msg"], auditLoginFailed)
+	}
+
+	if entry["request_id"] != "test-request" {
+		t.Errorf("Audit request_id %v, expected test-request", entry["request_id"])
+	}
+
+	if _, ok := entry["email"]; ok || entry["email_hash"] == "" {
+		t.Errorf("Expected only a hashed email in audit log, got %s", contents)
+	}
+
+	// The hash only depends on hash_key, so it stays the same when signing keys are rotated
+	hash := getHash(auditConfig.Log.Audit.HashKey, "user@example.com")
+	if expected := hex.EncodeToString(hash[:sha256.Size/2]); entry["email_hash"] != expected {
+		t.Errorf("Audit email_hash %v, expected %s", entry["email_hash"], expected)
+	}
+}
+
+func TestRouteAdminDebug(t *testing.T) {
+	adminConfig := getTestConfig()
+	adminConfig.Admin.Token = "admin-token-1234567890"
+	adminServer := &Server{Config: adminConfig}
+	router := adminServer.getRouter()
+	defer logLevel.Set(slog.LevelInfo)
+
+	req, err := http.NewRequest("PUT", "/api/admin/debug", strings.NewReader(`{"enabled": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	expectedStatus := 401
+
+	if recorder.Result().StatusCode != expectedStatus {
+		t.Errorf("/api/admin/debug without token returned status %d, expected %d", recorder.Result().StatusCode, expectedStatus)
+	}
+
+	req, err = http.NewRequest("PUT", "/api/admin/debug", strings.NewReader(`{"enabled": true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+adminConfig.Admin.Token)
+
+	recorder = httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	expectedStatus = 204
+
+	if recorder.Result().StatusCode != expectedStatus {
+		t.Errorf("/api/admin/debug returned status %d, expected %d", recorder.Result().StatusCode, expectedStatus)
+	}
+
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("Log level is %s after enabling debug", logLevel.Level())
+	}
+
+	if redactCode(adminServer, "ABCD1234") == "ABCD1234" {
+		t.Error("Code was not redacted outside of dev_mode")
+	}
+}
+
+func verifyTokenForHost(t *testing.T, router *chi.Mux, cookie *http.Cookie, host string) int {
+	req, err := http.NewRequest("GET", "/api/verify-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-Host", host)
+	req.AddCookie(cookie)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder.Result().StatusCode
+}
+
+func TestRouteVerifyTokenAudience(t *testing.T) {
+	sitesConfig := getTestConfig()
+	sitesConfig.Sites = []SiteConfig{
+		{Host: "a.example.com"},
+		{Host: "b.example.com", Audience: "site-b"},
+	}
+	sitesServer := &Server{Config: sitesConfig}
+	router := sitesServer.getRouter()
+
+	cookie := makeAuthCookie(sitesServer, "user@example.com", "a.example.com")
+	tests := map[string]int{
+		"a.example.com":       204,
+		"A.example.com:443":   204,
+		"b.example.com":       401,
+		"unknown.example.com": 401,
+		"":                    401,
+	}
+
+	for host, expectedStatus := range tests {
+		if status := verifyTokenForHost(t, router, cookie, host); status != expectedStatus {
+			t.Errorf("/api/verify-token for %q returned status %d, expected %d", host, status, expectedStatus)
+		}
+	}
+
+	// Logging in to site B keeps access to site A
+	buffer := bytes.NewBuffer([]byte{})
+	err := json.NewEncoder(buffer).Encode(emailVerifyRequest{
+		Email:  "user@example.com",
+		Code:   MakeVerifyCodeNow(sitesServer.signingKeys().active.codeKey, "user@example.com"),
+		Target: "https://b.example.com/some/page",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/email/verify", buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Expected a new cookie from /api/email/verify, got %d", len(cookies))
+	}
+
+	for _, host := range []string{"a.example.com", "b.example.com"} {
+		if status := verifyTokenForHost(t, router, cookies[0], host); status != 204 {
+			t.Errorf("/api/verify-token for %s after second login returned status %d, expected 204", host, status)
+		}
+	}
+}
+
+func TestValidateTokenIssuer(t *testing.T) {
+	issuerConfig := getTestConfig()
+	issuerConfig.JWT.Issuer = "https://login.example.com"
+	issuerServer := &Server{Config: issuerConfig}
+
+	token, err := MakeToken(issuerServer, "user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := validateToken(issuerServer, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.IssuedAt == nil || claims.NotBefore == nil {
+		t.Error("Token is missing iat or nbf")
+	}
+
+	// Tokens from another issuer sharing the key are not accepted
+	otherConfig := getTestConfig()
+	otherConfig.JWT.Issuer = "https://other.example.com"
+	if _, err := validateToken(&Server{Config: otherConfig}, token); err == nil {
+		t.Error("Token from another issuer passed validation")
+	}
+}
+
+// makeTestToken signs a token with the given claims using the server's active key
+func makeTestToken(t *testing.T, srv *Server, claims *tokenClaims) string {
+	keys := srv.signingKeys()
+	token := jwt.NewWithClaims(keys.method, claims)
+	token.Header["kid"] = keys.active.id
+	tokenString, err := token.SignedString(keys.active.signingKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokenString
+}
+
+func TestRouteVerifyTokenRefresh(t *testing.T) {
+	slidingConfig := getTestConfig()
+	slidingConfig.JWT.RefreshAfterSeconds = 60
+	slidingConfig.JWT.MaxSessionSeconds = 3600
+	slidingServer := &Server{Config: slidingConfig}
+	router := slidingServer.getRouter()
+
+	now := time.Now()
+	authTime := now.Add(-30 * time.Minute)
+	makeClaims := func(issuedAt time.Time, authTime time.Time) *tokenClaims {
+		return &tokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "user@example.com",
+				ID:        "session-id",
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			},
+			AuthTime: jwt.NewNumericDate(authTime),
+		}
+	}
+
+	getResponse := func(token string) *http.Response {
+		req, err := http.NewRequest("GET", "/api/verify-token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(&http.Cookie{Name: slidingConfig.CookieAuth.CookieName, Value: token})
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result()
+	}
+
+	// Fresh tokens are not refreshed
+	result := getResponse(makeTestToken(t, slidingServer, makeClaims(now, authTime)))
+	if result.StatusCode != 204 || len(result.Cookies()) != 0 {
+		t.Errorf("Fresh token returned status %d with %d cookies, expected 204 without cookies", result.StatusCode, len(result.Cookies()))
+	}
+
+	// Older tokens are refreshed within the same session
+	result = getResponse(makeTestToken(t, slidingServer, makeClaims(now.Add(-2*time.Minute), authTime)))
+	if result.StatusCode != 204 || len(result.Cookies()) != 1 {
+		t.Fatalf("Old token returned status %d with %d cookies, expected 204 with a cookie", result.StatusCode, len(result.Cookies()))
+	}
+
+	claims, err := validateToken(slidingServer, result.Cookies()[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.ID != "session-id" || claims.AuthTime.Unix() != authTime.Unix() {
+		t.Errorf("Refreshed token did not keep the session, got jti %s and auth_time %s", claims.ID, claims.AuthTime)
+	}
+
+	if claims.ExpiresAt.After(authTime.Add(time.Hour)) {
+		t.Errorf("Refreshed token expires at %s, after the maximum session length", claims.ExpiresAt)
+	}
+
+	// Sessions past the maximum length are rejected
+	result = getResponse(makeTestToken(t, slidingServer, makeClaims(now.Add(-2*time.Minute), now.Add(-2*time.Hour))))
+	if result.StatusCode != 401 {
+		t.Errorf("Token past maximum session length returned status %d, expected 401", result.StatusCode)
+	}
+}
+
+func TestRouteVerifyTokenIdle(t *testing.T) {
+	idleConfig := getTestConfig()
+	idleConfig.Sessions.IdleTimeoutSeconds = 600
+	idleConfig.Sessions.TouchIntervalSeconds = 60
+	idleServer := &Server{Config: idleConfig}
+	router := idleServer.getRouter()
+
+	now := time.Now()
+	makeToken := func(id string, issuedAt time.Time) *http.Cookie {
+		token := makeTestToken(t, idleServer, &tokenClaims{
+			RegisteredClaims: jwt.RegisteredClaims{
+				Subject:   "user@example.com",
+				ID:        id,
+				IssuedAt:  jwt.NewNumericDate(issuedAt),
+				ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+			},
+		})
+		return &http.Cookie{Name: idleConfig.CookieAuth.CookieName, Value: token}
+	}
+
+	// Unknown sessions are idle since the token was issued
+	status := verifyTokenForHost(t, router, makeToken("fresh", now.Add(-5*time.Minute)), "")
+	if status != 204 {
+		t.Errorf("Recently issued token returned status %d, expected 204", status)
+	}
+
+	status = verifyTokenForHost(t, router, makeToken("stale", now.Add(-15*time.Minute)), "")
+	if status != 401 {
+		t.Errorf("Token issued before the idle timeout returned status %d, expected 401", status)
+	}
+
+	// Recent use keeps old tokens alive
+	if err := idleServer.sessionStorage().put(&sessionInfo{ID: "used", LastSeen: now.Add(-5 * time.Minute), Expires: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	status = verifyTokenForHost(t, router, makeToken("used", now.Add(-50*time.Minute)), "")
+	if status != 204 {
+		t.Errorf("Recently used token returned status %d, expected 204", status)
+	}
+
+	session, err := idleServer.sessionStorage().get("used")
+	if err != nil || session == nil || time.Since(session.LastSeen) > time.Minute {
+		t.Errorf("Session last use was not updated, got %v", session)
+	}
+
+	// Uses within the touch interval are not written
+	if err := idleServer.sessionStorage().put(&sessionInfo{ID: "used", LastSeen: now.Add(-30 * time.Second), Expires: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	verifyTokenForHost(t, router, makeToken("used", now.Add(-50*time.Minute)), "")
+	session, _ = idleServer.sessionStorage().get("used")
+	if !session.LastSeen.Equal(now.Add(-30 * time.Second)) {
+		t.Errorf("Session last use was updated within the touch interval, got %s", session.LastSeen)
+	}
+}
+
+// loginForTest logs in through /api/email/verify and returns the auth cookie
+func loginForTest(t *testing.T, srv *Server, router *chi.Mux, email string, userAgent string) *http.Cookie {
+	buffer := bytes.NewBuffer([]byte{})
+	err := json.NewEncoder(buffer).Encode(emailVerifyRequest{
+		Email: email,
+		Code:  MakeVerifyCodeNow(srv.signingKeys().active.codeKey, email),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", "/api/email/verify", buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	if recorder.Result().StatusCode != 204 || len(recorder.Result().Cookies()) != 1 {
+		t.Fatalf("/api/email/verify returned status %d, expected 204 with a cookie", recorder.Result().StatusCode)
+	}
+	return recorder.Result().Cookies()[0]
+}
+
+// postForTest posts the payload as JSON to the path
+func postForTest(t *testing.T, router *chi.Mux, path string, payload interface{}) *http.Response {
+	buffer := bytes.NewBuffer([]byte{})
+	if err := json.NewEncoder(buffer).Encode(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest("POST", path, buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	return recorder.Result()
+}
+
+func TestRouteSessions(t *testing.T) {
+	registryConfig := getTestConfig()
+	registryConfig.Sessions.Registry = true
+	registryServer := &Server{Config: registryConfig}
+	router := registryServer.getRouter()
+
+	laptop := loginForTest(t, registryServer, router, "user@example.com", "laptop")
+	phone := loginForTest(t, registryServer, router, "user@example.com", "phone")
+	loginForTest(t, registryServer, router, "other@example.com", "other")
+
+	listSessions := func(router *chi.Mux, cookie *http.Cookie) (int, sessionsResponse) {
+		req, err := http.NewRequest("GET", "/api/sessions", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+
+		res := sessionsResponse{}
+		if recorder.Result().StatusCode == 200 {
+			if err := json.NewDecoder(recorder.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return recorder.Result().StatusCode, res
+	}
+
+	status, res := listSessions(router, laptop)
+	if status != 200 || len(res.Sessions) != 2 {
+		t.Fatalf("/api/sessions returned status %d with %d sessions, expected 200 with 2", status, len(res.Sessions))
+	}
+
+	var phoneID string
+	for _, session := range res.Sessions {
+		if session.UserAgent == "phone" {
+			phoneID = session.ID
+			if session.Current {
+				t.Error("Other session was reported as the current one")
+			}
+		}
+	}
+
+	revoke := func(cookie *http.Cookie, id string) int {
+		req, err := http.NewRequest("DELETE", "/api/sessions/"+id, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result().StatusCode
+	}
+
+	// Users can only revoke their own sessions
+	other := loginForTest(t, registryServer, router, "other@example.com", "other")
+	if status := revoke(other, phoneID); status != 404 {
+		t.Errorf("Revoking another user's session returned status %d, expected 404", status)
+	}
+
+	if status := revoke(laptop, phoneID); status != 204 {
+		t.Errorf("Revoking session returned status %d, expected 204", status)
+	}
+
+	if status := verifyTokenForHost(t, router, phone, ""); status != 401 {
+		t.Errorf("Revoked session returned status %d from /api/verify-token, expected 401", status)
+	}
+
+	if status := verifyTokenForHost(t, router, laptop, ""); status != 204 {
+		t.Errorf("Remaining session returned status %d from /api/verify-token, expected 204", status)
+	}
+
+	// The endpoints are not available without the registry
+	if status, _ := listSessions(testRouter, makeAuthCookie(&testServer, "user@example.com")); status != 404 {
+		t.Errorf("/api/sessions returned status %d without the registry, expected 404", status)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxyConfig := getTestConfig()
+	proxyConfig.Server.TrustedProxies = []string{"10.0.0.0/8", "::1"}
+	proxyServer := &Server{Config: proxyConfig}
+
+	var ip string
+	handler := proxyServer.resolveClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip = clientIP(r)
+	}))
+
+	tests := []struct {
+		remoteAddr string
+		realIP     string
+		expected   string
+	}{
+		{"10.1.2.3:5000", "192.0.2.10", "192.0.2.10"},
+		{"[::1]:5000", "192.0.2.10", "192.0.2.10"},
+		{"[::ffff:10.1.2.3]:5000", "192.0.2.10", "192.0.2.10"},
+		{"10.1.2.3:5000", "", "10.1.2.3"},
+		// Anyone else could claim to be anyone
+		{"198.51.100.7:5000", "192.0.2.10", "198.51.100.7"},
+		{"[2001:db8::1]:5000", "192.0.2.10", "2001:db8::1"},
+		// Unix sockets have no address
+		{"@", "192.0.2.10", "192.0.2.10"},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.RemoteAddr = test.remoteAddr
+		if test.realIP != "" {
+			req.Header.Set("X-Real-IP", test.realIP)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		if ip != test.expected {
+			t.Errorf("Client IP from %s with X-Real-IP %q was %s, expected %s", test.remoteAddr, test.realIP, ip, test.expected)
+		}
+	}
+}
+
+func TestRouteVerifyTokenBinding(t *testing.T) {
+	bindingConfig := getTestConfig()
+	bindingConfig.JWT.Binding = TokenBindingConfig{IP: true, IPv4Prefix: 24, IPv6Prefix: 64, UserAgent: true}
+	bindingServer := &Server{Config: bindingConfig}
+	router := bindingServer.getRouter()
+
+	loginReq, err := http.NewRequest("POST", "/api/email/verify", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginReq.Header.Set("X-Real-IP", "192.0.2.10")
+	loginReq.Header.Set("User-Agent", "browser")
+
+	recorder := httptest.NewRecorder()
+	if err := setAuthCookie(bindingServer, recorder, loginReq, "user@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	cookie := recorder.Result().Cookies()[0]
+
+	verify := func(ip string, userAgent string) int {
+		req, err := http.NewRequest("GET", "/api/verify-token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Real-IP", ip)
+		req.Header.Set("User-Agent", userAgent)
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result().StatusCode
+	}
+
+	if status := verify("192.0.2.99", "browser"); status != 204 {
+		t.Errorf("Token used within the same network returned status %d, expected 204", status)
+	}
+
+	if status := verify("198.51.100.10", "browser"); status != 401 {
+		t.Errorf("Token used from another network returned status %d, expected 401", status)
+	}
+
+	if status := verify("192.0.2.10", "other browser"); status != 401 {
+		t.Errorf("Token used from another browser returned status %d, expected 401", status)
+	}
+
+	// Tokens issued without binding are not accepted
+	if status := verify("192.0.2.10", "browser"); status != 204 {
+		t.Errorf("Token used from the original client returned status %d, expected 204", status)
+	}
+	cookie = makeAuthCookie(bindingServer, "user@example.com")
+	if status := verify("192.0.2.10", "browser"); status != 401 {
+		t.Errorf("Unbound token returned status %d, expected 401", status)
+	}
+}
+
+func TestRouteVerifyTokenEncrypted(t *testing.T) {
+	encryptConfig := getTestConfig()
+	encryptConfig.JWT.Encrypt = true
+	encryptServer := &Server{Config: encryptConfig}
+	router := encryptServer.getRouter()
+
+	cookie := makeAuthCookie(encryptServer, "user@example.com")
+	if !strings.HasPrefix(cookie.Value, tokenEnvelopePrefix) {
+		t.Fatalf("Token was not encrypted: %s", cookie.Value)
+	}
+
+	req, err := http.NewRequest("GET", "/api/verify-token", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.AddCookie(cookie)
+
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, req)
+	result := recorder.Result()
+
+	if result.StatusCode != 204 {
+		t.Errorf("/api/verify-token returned status %d, expected 204", result.StatusCode)
+	}
+
+	if email := result.Header.Get("X-Praga-Email"); email != "user@example.com" {
+		t.Errorf("/api/verify-token returned X-Praga-Email %q, expected user@example.com", email)
+	}
+}
+
+func TestRouteEmailVerifySingleUse(t *testing.T) {
+	singleUseConfig := getTestConfig()
+	singleUseConfig.Auth.SingleUseCodes = true
+	singleUseServer := &Server{Config: singleUseConfig}
+	router := singleUseServer.getRouter()
+	email := "user@example.com"
+
+	// Codes derived from the email are not accepted
+	derived := MakeVerifyCodeNow(singleUseServer.signingKeys().active.codeKey, email)
+	if status := postForTest(t, router, "/api/email/verify", emailVerifyRequest{Email: email, Code: derived}).StatusCode; status != 400 {
+		t.Errorf("Derived code returned status %d, expected 400", status)
+	}
+
+	if status := postForTest(t, router, "/api/email/send", emailSendRequest{Email: email}).StatusCode; status != 204 {
+		t.Fatalf("/api/email/send returned status %d, expected 204", status)
+	}
+	code := testLastSentCode
+
+	if status := postForTest(t, router, "/api/email/verify", emailVerifyRequest{Email: "other@example.com", Code: code}).StatusCode; status != 400 {
+		t.Errorf("Code for another email returned status %d, expected 400", status)
+	}
+
+	if status := postForTest(t, router, "/api/email/verify", emailVerifyRequest{Email: email, Code: code}).StatusCode; status != 204 {
+		t.Errorf("Issued code returned status %d, expected 204", status)
+	}
+
+	if status := postForTest(t, router, "/api/email/verify", emailVerifyRequest{Email: email, Code: code}).StatusCode; status != 400 {
+		t.Errorf("Reused code returned status %d, expected 400", status)
+	}
+}
+
+func TestRouteEmailSendVerifyNormalized(t *testing.T) {
+	testLastSentCode = ""
+	if result := postForTest(t, testRouter, "/api/email/send", emailSendRequest{Email: "User@Example.COM"}); result.StatusCode != 204 {
+		t.Fatalf("/api/email/send returned status %d, expected 204", result.StatusCode)
+	}
+	if testLastSentCode != MakeVerifyCodeNow(testServer.signingKeys().active.codeKey, "user@example.com") {
+		t.Fatalf("Mixed case email was not sent the code for the normalized email, got %q", testLastSentCode)
+	}
+
+	result := postForTest(t, testRouter, "/api/email/verify", emailVerifyRequest{Email: "USER@example.com", Code: testLastSentCode})
+	if result.StatusCode != 204 {
+		t.Fatalf("/api/email/verify returned status %d, expected 204", result.StatusCode)
+	}
+
+	claims, err := validateToken(&testServer, result.Cookies()[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != "user@example.com" {
+		t.Errorf("Token subject %s, expected user@example.com", claims.Subject)
+	}
+}
+
+func TestRouteEmailSendAllowlist(t *testing.T) {
+	allowlistConfig := getTestConfig()
+	allowlistConfig.Email.ValidDomains = []string{"example.com", "*.corp.example.com"}
+	allowlistConfig.Email.ValidEmails = []EmailEntry{{Email: "guest@partner.example.com"}}
+	allowlistConfig.Email.AllowPatterns = []string{"ops-*@eu.example.com", `/^[a-z]+\.[a-z]+@staff\.example\.com$/`}
+	allowlistConfig.Email.DenyPatterns = []string{"contractor-*@corp.example.com", "*@legacy.corp.example.com", "/^admin@/"}
+	allowlistServer := &Server{Config: allowlistConfig}
+	allowlistRouter := allowlistServer.getRouter()
+
+	tests := []struct {
+		email   string
+		allowed bool
+	}{
+		{"user@example.com", true},
+		{"user@other.example.com", false},
+		{"user@corp.example.com", false},
+		{"user@eu.corp.example.com", true},
+		{"user@a.b.corp.example.com", true},
+		{"user@notcorp.example.com", false},
+		{"guest@partner.example.com", true},
+		{"GUEST@Partner.Example.com", true},
+		{"other@partner.example.com", false},
+		{"ops-alice@eu.example.com", true},
+		{"OPS-Bob@EU.example.com", true},
+		{"dev-alice@eu.example.com", false},
+		{"first.last@staff.example.com", true},
+		{"firstlast@staff.example.com", false},
+		{"contractor-alice@corp.example.com", false},
+		{"contractor-a/b@corp.example.com", false},
+		{"contractor-alice@eu.corp.example.com", true},
+		{"user@legacy.corp.example.com", false},
+		{"admin@example.com", false},
+		{"admin@eu.corp.example.com", false},
+	}
+
+	for _, test := range tests {
+		buffer := bytes.NewBuffer([]byte{})
+		if err := json.NewEncoder(buffer).Encode(emailSendRequest{Email: test.email}); err != nil {
+			t.Fatal(err)
+		}
+
+		req, err := http.NewRequest("POST", "/api/email/send", buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testLastSentCode = ""
+		recorder := httptest.NewRecorder()
+		allowlistRouter.ServeHTTP(recorder, req)
+
+		if recorder.Result().StatusCode != 204 {
+			t.Errorf("/api/email/send for %s returned status %d, expected 204", test.email, recorder.Result().StatusCode)
+		}
+		if sent := testLastSentCode != ""; sent != test.allowed {
+			t.Errorf("Code sent to %s: %v, expected %v", test.email, sent, test.allowed)
+		}
+	}
+}
+
+func TestRouteExpiringAccess(t *testing.T) {
+	now := time.Now()
+	expiringConfig := getTestConfig()
+	expiringConfig.Email.ValidDomains = []string{}
+	expiringConfig.Email.ValidEmails = []EmailEntry{
+		{Email: "auditor@example.com", ValidUntil: now.Add(time.Hour)},
+		{Email: "future@example.com", ValidFrom: now.Add(time.Hour)},
+	}
+	expiringConfig.Email.Groups = []EmailGroupConfig{{
+		Name:       "contractors",
+		Emails:     []EmailEntry{{Email: "contractor@example.com"}},
+		ValidUntil: now.Add(time.Hour),
+	}}
+	expiringServer := &Server{Config: expiringConfig}
+	router := expiringServer.getRouter()
+
+	for email, allowed := range map[string]bool{"auditor@example.com": true, "contractor@example.com": true, "future@example.com": false} {
+		testLastSentCode = ""
+		postForTest(t, router, "/api/email/send", emailSendRequest{Email: email})
+		if sent := testLastSentCode != ""; sent != allowed {
+			t.Errorf("Code sent to %s: %v, expected %v", email, sent, allowed)
+		}
+	}
+
+	auditor := loginForTest(t, expiringServer, router, "auditor@example.com", "")
+	contractor := loginForTest(t, expiringServer, router, "contractor@example.com", "")
+	if status := verifyTokenForHost(t, router, auditor, ""); status != 204 {
+		t.Errorf("Token for active entry returned status %d, expected 204", status)
+	}
+
+	// Once the entries expire codes are no longer accepted and already issued tokens stop working
+	expiringServer.Config.Email.ValidEmails[0].ValidUntil = now.Add(-time.Minute)
+	expiringServer.Config.Email.Groups[0].ValidUntil = now.Add(-time.Minute)
+	expiringServer.allowlist = nil
+
+	code := MakeVerifyCodeNow(expiringServer.signingKeys().active.codeKey, "auditor@example.com")
+	if status := postForTest(t, router, "/api/email/verify", emailVerifyRequest{Email: "auditor@example.com", Code: code}).StatusCode; status != 400 {
+		t.Errorf("Code for expired entry returned status %d, expected 400", status)
+	}
+
+	for _, cookie := range []*http.Cookie{auditor, contractor} {
+		if status := verifyTokenForHost(t, router, cookie, ""); status != 401 {
+			t.Errorf("Token for expired entry returned status %d, expected 401", status)
+		}
+	}
+
+	// Removing the entries altogether does not keep the tokens working either
+	expiringServer.Config.Email.ValidEmails = expiringServer.Config.Email.ValidEmails[1:]
+	expiringServer.allowlist = nil
+	removed := makeAuthCookie(expiringServer, "removed@example.com")
+	for _, cookie := range []*http.Cookie{auditor, removed} {
+		if status := verifyTokenForHost(t, router, cookie, ""); status != 401 {
+			t.Errorf("Token for removed entry returned status %d, expected 401", status)
+		}
+	}
+}
+
+func TestRouteAccessRequests(t *testing.T) {
+	accessConfig := getTestConfig()
+	accessConfig.Admin.Token = "admin-token-1234567890"
+	accessConfig.URL = "https://auth.example.com/"
+	accessConfig.AccessRequests = AccessRequestsConfig{
+		Enabled:           true,
+		Approvers:         []string{"approver@example.com"},
+		RequestValidHours: 1,
+		GrantDays:         30,
+	}
+	accessServer := &Server{Config: accessConfig}
+	router := accessServer.getRouter()
+
+	request := func(method string, path string, payload interface{}) *http.Response {
+		buffer := bytes.NewBuffer([]byte{})
+		if payload != nil {
+			if err := json.NewEncoder(buffer).Encode(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req, err := http.NewRequest(method, path, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+accessConfig.Admin.Token)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result()
+	}
+
+	// Sends the access request, returning the approve and deny tokens sent to the approver
+	requestAccess := func(email string) (string, string) {
+		testLastSentNotice = ""
+		if result := request("POST", "/api/access/request", accessRequestRequest{Email: email, Reason: "Yearly audit"}); result.StatusCode != 204 {
+			t.Fatalf("/api/access/request returned status %d, expected 204", result.StatusCode)
+		}
+
+		matches := regexp.MustCompile(`https://auth\.example\.com/access/\?token=(\S+)`).FindAllStringSubmatch(testLastSentNotice, -1)
+		if len(matches) != 2 {
+			t.Fatalf("Approver was not sent the links, got %q", testLastSentNotice)
+		}
+
+		var tokens []string
+		for _, match := range matches {
+			token, err := url.QueryUnescape(match[1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			tokens = append(tokens, token)
+		}
+		return tokens[0], tokens[1]
+	}
+
+	// Disabled by default
+	disabledRequest, err := http.NewRequest("POST", "/api/access/request", strings.NewReader(`{"email": "guest@partner.example.com", "reason": "Audit"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	testRouter.ServeHTTP(recorder, disabledRequest)
+	if recorder.Result().StatusCode != 404 {
+		t.Errorf("Disabled access requests returned status %d, expected 404", recorder.Result().StatusCode)
+	}
+
+	// Approvers are not bothered about emails that are already allowed
+	testLastSentNotice = ""
+	request("POST", "/api/access/request", accessRequestRequest{Email: "user@example.com", Reason: "Audit"})
+	if testLastSentNotice != "" {
+		t.Errorf("Access request for allowed email was sent to approvers: %q", testLastSentNotice)
+	}
+
+	approve, deny := requestAccess("Guest@Partner.example.com")
+	if emailAllowed(accessServer, "guest@partner.example.com") {
+		t.Fatal("Email was allowed before approval")
+	}
+
+	result := request("GET", "/api/access/decision?token="+url.QueryEscape(approve), nil)
+	decision := accessDecisionResponse{}
+	if err := json.NewDecoder(result.Body).Decode(&decision); err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != 200 || decision.Email != "guest@partner.example.com" || !decision.Approve || decision.Reason != "Yearly audit" {
+		t.Errorf("/api/access/decision returned status %d, %+v", result.StatusCode, decision)
+	}
+
+	if result := request("POST", "/api/access/decide", accessDecideRequest{Token: approve[:len(approve)-2] + "xx"}); result.StatusCode != 400 {
+		t.Errorf("Tampered link returned status %d, expected 400", result.StatusCode)
+	}
+
+	if result := request("POST", "/api/access/decide", accessDecideRequest{Token: approve}); result.StatusCode != 204 {
+		t.Fatalf("/api/access/decide returned status %d, expected 204", result.StatusCode)
+	}
+	if !emailAllowed(accessServer, "guest@partner.example.com") {
+		t.Fatal("Email was not allowed after approval")
+	}
+
+	// The request is decided only once
+	if result := request("POST", "/api/access/decide", accessDecideRequest{Token: deny}); result.StatusCode != 404 {
+		t.Errorf("Deciding again returned status %d, expected 404", result.StatusCode)
+	}
+
+	result = request("GET", "/api/admin/access", nil)
+	var grants []accessGrantResponse
+	if err := json.NewDecoder(result.Body).Decode(&grants); err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].GrantedBy != "approver@example.com" || !grants[0].Active || time.Until(grants[0].ValidUntil) < 29*24*time.Hour {
+		t.Errorf("Dynamic allowlist was %+v", grants)
+	}
+
+	// Revoking access also ends the existing sessions
+	cookie := loginForTest(t, accessServer, router, "guest@partner.example.com", "")
+	if status := verifyTokenForHost(t, router, cookie, ""); status != 204 {
+		t.Errorf("Token of approved email returned status %d, expected 204", status)
+	}
+
+	if result := request("DELETE", "/api/admin/access/guest@partner.example.com", nil); result.StatusCode != 204 {
+		t.Errorf("Revoking access returned status %d, expected 204", result.StatusCode)
+	}
+	if status := verifyTokenForHost(t, router, cookie, ""); status != 401 {
+		t.Errorf("Token of revoked email returned status %d, expected 401", status)
+	}
+
+	// Denied requests are not added
+	_, deny = requestAccess("other@partner.example.com")
+	if result := request("POST", "/api/access/decide", accessDecideRequest{Token: deny}); result.StatusCode != 204 {
+		t.Fatalf("/api/access/decide returned status %d, expected 204", result.StatusCode)
+	}
+	if emailAllowed(accessServer, "other@partner.example.com") {
+		t.Error("Email was allowed after denial")
+	}
+}
+
+func TestRouteInvitations(t *testing.T) {
+	inviteConfig := getTestConfig()
+	inviteConfig.Admin.Token = "admin-token-1234567890"
+	inviteConfig.URL = "https://auth.example.com"
+	inviteConfig.Email.Groups = []EmailGroupConfig{
+		{Name: "contractors", ValidUntil: time.Now().Add(24 * time.Hour)},
+		{Name: "interns", ValidUntil: time.Now().Add(-time.Hour)},
+	}
+	inviteConfig.Sessions.Store = "file"
+	inviteConfig.Sessions.Path = filepath.Join(t.TempDir(), "sessions.db")
+	inviteServer := &Server{Config: inviteConfig}
+	defer inviteServer.sessionStorage().Close()
+	router := inviteServer.getRouter()
+
+	request := func(method string, path string, payload interface{}) *http.Response {
+		buffer := bytes.NewBuffer([]byte{})
+		if payload != nil {
+			if err := json.NewEncoder(buffer).Encode(payload); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		req, err := http.NewRequest(method, path, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+inviteConfig.Admin.Token)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result()
+	}
+
+	// Creates the invitation, returning the token of the link and the ID of the invitation
+	invite := func(invitation adminInvitationRequest) (string, string) {
+		result := request("POST", "/api/admin/invitations", invitation)
+		response := adminInvitationResponse{}
+		if err := json.NewDecoder(result.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+
+		token, ok := strings.CutPrefix(response.URL, "https://auth.example.com/invitation/?token=")
+		if result.StatusCode != 200 || !ok || response.ID == "" {
+			t.Fatalf("/api/admin/invitations returned status %d, %+v", result.StatusCode, response)
+		}
+		token, err := url.QueryUnescape(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token, response.ID
+	}
+
+	if result := request("POST", "/api/admin/invitations", adminInvitationRequest{Email: "hire@new.example.com", Groups: []string{"unknown"}}); result.StatusCode != 400 {
+		t.Errorf("Invitation to unknown group returned status %d, expected 400", result.StatusCode)
+	}
+	if result := request("POST", "/api/admin/invitations", adminInvitationRequest{Email: "hire@new.example.com", ValidDays: 400}); result.StatusCode != 400 {
+		t.Errorf("Invitation valid for 400 days returned status %d, expected 400", result.StatusCode)
+	}
+
+	// The memory store would forget the used invitations on restart, letting them be accepted again
+	memoryConfig := inviteConfig
+	memoryConfig.Sessions = SessionsConfig{Store: "memory"}
+	memoryServer := &Server{Config: memoryConfig}
+	if _, err := MakeInvitation(memoryServer, &Invitation{Email: "hire@new.example.com"}, time.Now().Add(time.Hour)); err == nil {
+		t.Error("Invitation was made with the memory session store")
+	}
+	memoryToken, _ := invite(adminInvitationRequest{Email: "hire@new.example.com"})
+	if result := postForTest(t, memoryServer.getRouter(), "/api/invitations/accept", invitationRequest{Token: memoryToken}); result.StatusCode != 404 {
+		t.Errorf("Accepting invitation with the memory session store returned status %d, expected 404", result.StatusCode)
+	}
+
+	testLastSentNotice = ""
+	token, _ := invite(adminInvitationRequest{Email: "Hire@New.example.com", Groups: []string{"contractors"}, AccessDays: 30, Send: true})
+	if !strings.Contains(testLastSentNotice, url.QueryEscape(token)) {
+		t.Errorf("Invitation was not sent, got %q", testLastSentNotice)
+	}
+
+	// Following the link only shows the invitation
+	result := request("GET", "/api/invitations?token="+url.QueryEscape(token), nil)
+	invitation := invitationResponse{}
+	if err := json.NewDecoder(result.Body).Decode(&invitation); err != nil {
+		t.Fatal(err)
+	}
+	if result.StatusCode != 200 || invitation.Email != "hire@new.example.com" || invitation.ValidUntil == nil {
+		t.Errorf("/api/invitations returned status %d, %+v", result.StatusCode, invitation)
+	}
+	if emailAllowed(inviteServer, "hire@new.example.com") {
+		t.Fatal("Email was allowed before accepting the invitation")
+	}
+
+	if result := request("POST", "/api/invitations/accept", invitationRequest{Token: token[:len(token)-2] + "xx"}); result.StatusCode != 400 {
+		t.Errorf("Tampered invitation returned status %d, expected 400", result.StatusCode)
+	}
+
+	// Accepting sends a code to log in with
+	testLastSentCode = ""
+	if result := request("POST", "/api/invitations/accept", invitationRequest{Token: token}); result.StatusCode != 204 {
+		t.Fatalf("/api/invitations/accept returned status %d, expected 204", result.StatusCode)
+	}
+	if testLastSentCode == "" {
+		t.Error("No code was sent after accepting the invitation")
+	}
+	if !emailAllowed(inviteServer, "hire@new.example.com") {
+		t.Fatal("Email was not allowed after accepting the invitation")
+	}
+
+	grant, err := inviteServer.sessionStorage().getAccessGrant("hire@new.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if grant.GrantedBy != "admin API" || time.Until(grant.ValidUntil) < 29*24*time.Hour || len(grant.Groups) != 1 {
+		t.Errorf("Invitation granted %+v", grant)
+	}
+
+	// Following the link again only sends a new code
+	testLastSentCode = ""
+	if result := request("POST", "/api/invitations/accept", invitationRequest{Token: token}); result.StatusCode != 204 || testLastSentCode == "" {
+		t.Errorf("Accepting the invitation again returned status %d, expected 204 with a new code", result.StatusCode)
+	}
+
+	// Neither the revoked invitation nor others made before the revocation can be accepted
+	pending, _ := invite(adminInvitationRequest{Email: "hire@new.example.com"})
+	if err := revokeAccessGrant(inviteServer, "hire@new.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{token, pending} {
+		testLastSentCode = ""
+		result := request("POST", "/api/invitations/accept", invitationRequest{Token: token})
+		if result.StatusCode != 410 || emailAllowed(inviteServer, "hire@new.example.com") || testLastSentCode != "" {
+			t.Errorf("Invitation was accepted after revoking the access, status %d", result.StatusCode)
+		}
+	}
+	if result := request("GET", "/api/invitations?token="+url.QueryEscape(pending), nil); result.StatusCode != 410 {
+		t.Errorf("/api/invitations for revoked email returned status %d, expected 410", result.StatusCode)
+	}
+
+	// A new invitation gives the access back
+	token, _ = invite(adminInvitationRequest{Email: "hire@new.example.com"})
+	request("POST", "/api/invitations/accept", invitationRequest{Token: token})
+	if !emailAllowed(inviteServer, "hire@new.example.com") {
+		t.Error("New invitation did not give access back after revoking it")
+	}
+
+	// Cancelled invitations can't be accepted
+	token, id := invite(adminInvitationRequest{Email: "other@new.example.com"})
+	if result := request("DELETE", "/api/admin/invitations/not-an-id", nil); result.StatusCode != 400 {
+		t.Errorf("Cancelling invalid invitation returned status %d, expected 400", result.StatusCode)
+	}
+	if result := request("DELETE", "/api/admin/invitations/"+id, nil); result.StatusCode != 204 {
+		t.Errorf("Cancelling invitation returned status %d, expected 204", result.StatusCode)
+	}
+	if result := request("POST", "/api/invitations/accept", invitationRequest{Token: token}); result.StatusCode != 410 || emailAllowed(inviteServer, "other@new.example.com") {
+		t.Errorf("Cancelled invitation was accepted, status %d", result.StatusCode)
+	}
+
+	// The access ends with the groups
+	token, _ = invite(adminInvitationRequest{Email: "intern@new.example.com", Groups: []string{"interns"}})
+	request("POST", "/api/invitations/accept", invitationRequest{Token: token})
+	if emailAllowed(inviteServer, "intern@new.example.com") {
+		t.Error("Email invited to an expired group was allowed")
+	}
+}
+
+func TestRouteBlockedDomains(t *testing.T) {
+	blockedConfig := getTestConfig()
+	blockedConfig.Email.BlockedDomains = []string{"spam.example.com"}
+	blockedConfig.Log.Audit = AuditConfig{Path: filepath.Join(t.TempDir(), "audit.log")}
+
+	audit, err := newAuditLog(blockedConfig.Log.Audit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	blockedServer := &Server{Config: blockedConfig, audit: audit}
+	router := blockedServer.getRouter()
+
+	for _, email := range []string{"one@spam.example.com", "two@spam.example.com"} {
+		testLastSentCode = ""
+		req, err := http.NewRequest("POST", "/api/email/send", strings.NewReader(`{"email": "`+email+`"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+
+		if recorder.Result().StatusCode != 204 {
+			t.Errorf("/api/email/send returned status %d, expected 204", recorder.Result().StatusCode)
+		}
+		if testLastSentCode != "" {
+			t.Errorf("Code was sent to blocked email %s", email)
+		}
+	}
+
+	file, err := os.Open(blockedConfig.Log.Audit.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for expected := 1; expected <= 2; expected++ {
+		var entry map[string]interface{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry["msg"] != auditCodeBlocked || entry["rule"] != "blocked_domains spam.example.com" || entry["attempts"] != float64(expected) {
+			t.Errorf("Audit entry %v, expected %s with %d attempts", entry, auditCodeBlocked, expected)
+		}
+	}
+}
+
+func TestRouteAuthzWebhook(t *testing.T) {
+	var calls []authzRequest
+	failing := false
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request authzRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Error(err)
+		}
+		calls = append(calls, request)
+
+		if failing {
+			w.WriteHeader(500)
+			return
+		}
+
+		decision := authzDecision{
+			Allow: request.Email == "staff@example.com" && request.Host != "payroll.example.com" &&
+				!strings.HasPrefix(request.Path, "/admin"),
+		}
+		if decision.Allow {
+			decision.Groups = []string{"engineering", "oncall"}
+		}
+		if err := json.NewEncoder(w).Encode(decision); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer webhook.Close()
+
+	authzConfig := getTestConfig()
+	authzConfig.AuthzWebhook = AuthzWebhookConfig{
+		URL:            webhook.URL,
+		TimeoutSeconds: 1,
+		CacheSeconds:   60,
+		VerifyToken:    true,
+	}
+	authzConfig.URL = "https://auth.example.com"
+	authzServer := &Server{Config: authzConfig}
+	authzServer.Config.Sessions = SessionsConfig{Store: "file", Path: filepath.Join(t.TempDir(), "sessions.db")}
+	defer authzServer.sessionStorage().Close()
+	router := authzServer.getRouter()
+
+	send := func(email string) bool {
+		testLastSentCode = ""
+		payload := `{"email": "` + email + `", "target": "https://app.example.com/start"}`
+		req, err := http.NewRequest("POST", "/api/email/send", strings.NewReader(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		router.ServeHTTP(httptest.NewRecorder(), req)
+		return testLastSentCode != ""
+	}
+
+	verify := func(cookie *http.Cookie, host string, path string) *http.Response {
+		req, err := http.NewRequest("GET", "/api/verify-token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-Host", host)
+		req.Header.Set("X-Original-URI", path+"?page=1")
+		req.AddCookie(cookie)
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result()
+	}
+
+	if !send("staff@example.com") {
+		t.Error("No code was sent to email allowed by the webhook")
+	}
+	if send("former@example.com") {
+		t.Error("Code was sent to email denied by the webhook")
+	}
+	expected := authzRequest{Email: "staff@example.com", Host: "app.example.com", Path: "/start"}
+	if len(calls) != 2 || calls[0] != expected {
+		t.Errorf("Webhook was called with %+v, expected %+v first", calls, expected)
+	}
+
+	// Decisions are cached
+	send("staff@example.com")
+	if len(calls) != 2 {
+		t.Errorf("Webhook was called %d times, expected the decision to be cached", len(calls))
+	}
+
+	// Accepting an invitation or verifying a code does not get around the webhook
+	link, err := MakeInvitation(authzServer, &Invitation{Email: "former@example.com", InvitedBy: "test"}, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := url.QueryUnescape(link[strings.Index(link, "token=")+len("token="):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	testLastSentCode = ""
+	postForTest(t, router, "/api/invitations/accept", invitationRequest{Token: token})
+	if testLastSentCode != "" {
+		t.Error("Code was sent for invitation to email denied by the webhook")
+	}
+
+	code, err := issueCode(authzServer, "former@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := postForTest(t, router, "/api/email/verify", emailVerifyRequest{Email: "former@example.com", Code: code})
+	if result.StatusCode != 400 || len(result.Cookies()) != 0 {
+		t.Errorf("Verifying code of email denied by the webhook returned status %d, expected 400", result.StatusCode)
+	}
+
+	cookie := makeAuthCookie(authzServer, "staff@example.com")
+	result = verify(cookie, "app.example.com", "/wiki")
+	if result.StatusCode != 204 || result.Header.Get("X-Praga-Groups") != "engineering,oncall" {
+		t.Errorf("/api/verify-token returned status %d with groups %q", result.StatusCode, result.Header.Get("X-Praga-Groups"))
+	}
+
+	// Decisions are cached per path, so allowing one path on a host does not allow the others and the other way around
+	calls = nil
+	if status := verify(cookie, "app.example.com", "/admin").StatusCode; status != 403 {
+		t.Errorf("/api/verify-token for path denied by the webhook returned status %d, expected 403", status)
+	}
+	if status := verify(cookie, "app.example.com", "/wiki").StatusCode; status != 204 {
+		t.Errorf("/api/verify-token for path allowed by the webhook returned status %d, expected 204", status)
+	}
+	if status := verify(cookie, "app.example.com", "/admin").StatusCode; status != 403 {
+		t.Errorf("/api/verify-token for path denied by the webhook returned status %d, expected 403", status)
+	}
+	if len(calls) != 1 || calls[0].Path != "/admin" {
+		t.Errorf("Webhook was called with %+v, expected only once for /admin", calls)
+	}
+
+	// Denying a site does not log the user out
+	result = verify(cookie, "payroll.example.com", "/")
+	if result.StatusCode != 403 || len(result.Cookies()) != 0 {
+		t.Errorf("/api/verify-token for denied site returned status %d, expected 403 keeping the cookie", result.StatusCode)
+	}
+
+	// Failures are not cached, and deny access unless failing open
+	failing = true
+	if verify(cookie, "status.example.com", "/").StatusCode != 403 {
+		t.Error("Failing webhook did not deny access")
+	}
+
+	authzConfig.AuthzWebhook.FailOpen = true
+	openServer := &Server{Config: authzConfig}
+	router = openServer.getRouter()
+	if status := verify(makeAuthCookie(openServer, "staff@example.com"), "status.example.com", "/").StatusCode; status != 204 {
+		t.Errorf("Failing webhook returned status %d failing open, expected 204", status)
+	}
+
+	// Without the original path from Nginx the client could pick the path to check
+	if status := verifyTokenForHost(t, router, makeAuthCookie(openServer, "staff@example.com"), "app.example.com"); status != 403 {
+		t.Errorf("/api/verify-token without X-Original-URI returned status %d, expected 403", status)
+	}
+
+	// The cache stays within its size however many emails and hosts are seen
+	aw := newAuthzWebhook(authzConfig.AuthzWebhook)
+	now := time.Now()
+	for i := 0; i < authzCacheSize+10; i++ {
+		aw.store(authzRequest{Email: fmt.Sprintf("user%d@example.com", i), Host: "app.example.com"}, authzDecision{Allow: true}, now)
+	}
+	if len(aw.cache) > authzCacheSize {
+		t.Errorf("Cache has %d decisions, expected at most %d", len(aw.cache), authzCacheSize)
+	}
+
+	// By default the webhook only decides for the emails the allowlist allows, standalone it decides on its own
+	failing = false
+	authzConfig.AuthzWebhook.FailOpen = false
+	authzConfig.Email.ValidDomains = []string{}
+	authzConfig.Email.DenyPatterns = []string{"former@*"}
+	router = (&Server{Config: authzConfig}).getRouter()
+	if send("staff@example.com") {
+		t.Error("Code was sent to email allowed by the webhook but not by the allowlist")
+	}
+
+	authzConfig.AuthzWebhook.Standalone = true
+	standaloneServer := &Server{Config: authzConfig}
+	router = standaloneServer.getRouter()
+	if !send("staff@example.com") {
+		t.Error("No code was sent to email allowed by the standalone webhook")
+	}
+	if status := verify(makeAuthCookie(standaloneServer, "staff@example.com"), "app.example.com", "/wiki").StatusCode; status != 204 {
+		t.Errorf("/api/verify-token for email allowed by the standalone webhook returned status %d, expected 204", status)
+	}
+	if status := verify(makeAuthCookie(standaloneServer, "former@example.com"), "app.example.com", "/wiki").StatusCode; status != 401 {
+		t.Errorf("/api/verify-token for email denied by deny_patterns returned status %d, expected 401", status)
+	}
+}
+
+func TestRouteVerifyTokenPolicy(t *testing.T) {
+	policyConfig := getTestConfig()
+	policyConfig.Email.Groups = []EmailGroupConfig{{Name: "engineering", Emails: []EmailEntry{{Email: "dev@example.com"}}}}
+	policyConfig.Policy = PolicyConfig{Rules: []PolicyRuleConfig{
+		{Name: "engineering", Expression: `path == "/health" || path.startsWith("/public/") || ("engineering" in groups && method == "GET")`},
+	}}
+	policyServer := &Server{Config: policyConfig}
+	router := policyServer.getRouter()
+
+	verify := func(email string, method string, path string) *http.Response {
+		req, err := http.NewRequest("GET", "/api/verify-token", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != "" {
+			req.Header.Set("X-Original-URI", path)
+		}
+		if method != "" {
+			req.Header.Set("X-Original-Method", method)
+		}
+		req.AddCookie(makeAuthCookie(policyServer, email))
+
+		recorder := httptest.NewRecorder()
+		router.ServeHTTP(recorder, req)
+		return recorder.Result()
+	}
+
+	tests := []struct {
+		email  string
+		method string
+		path   string
+		status int
+	}{
+		{"dev@example.com", "GET", "/app", 204},
+		{"dev@example.com", "POST", "/app", 403},
+		{"user@example.com", "GET", "/app", 403},
+		{"user@example.com", "GET", "/health", 204},
+		{"user@example.com", "GET", "/public/page?q=1", 204},
+		// Paths are cleaned before the rules see them, so dot segments can't get past a prefix rule
+		{"user@example.com", "GET", "/public/../admin", 403},
+		{"user@example.com", "GET", "/public/%2e%2e/admin", 403},
+		{"user@example.com", "GET", "/public/./../admin/", 403},
+		{"user@example.com", "GET", "//health", 204},
+		{"user@example.com", "GET", "/public/..", 403},
+		{"user@example.com", "GET", "admin", 403},
+		// Missing headers deny access instead of matching as empty strings
+		{"dev@example.com", "GET", "", 403},
+		{"dev@example.com", "", "/app", 403},
+	}
+
+	for _, test := range tests {
+		result := verify(test.email, test.method, test.path)
+		if result.StatusCode != test.status {
+			t.Errorf("/api/verify-token for %s %s %s returned status %d, expected %d", test.email, test.method, test.path, result.StatusCode, test.status)
+		}
+		if result.StatusCode == 403 && len(result.Cookies()) != 0 {
+			t.Errorf("Denying %s %s %s cleared the cookie", test.email, test.method, test.path)
+		}
+	}
+}
@@ -6,31 +6,160 @@ import (
 	"fmt"
 	"io/fs"
 	"log"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"os"
 	"os/signal"
+	"reflect"
 	"strings"
+	"sync"
 	"syscall"
 
 	"github.com/cocreators-ee/praga"
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-chi/chi/v5/middleware"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/unrolled/secure"
 )
 
-const debug = false
-
 // Server provides the interface for setting up a HTTP server
 type Server struct {
 	Config        Config
+	ConfigPath    string
 	MailjetSender *MailjetSender
+	// Debug forces debug logging regardless of the configured level, it's kept when the configuration is reloaded
+	Debug bool
+
+	configLock sync.RWMutex
+	audit      *auditLog
+	keysLock   sync.Mutex
+	keys       *keyRing
+
+	sessionsLock sync.Mutex
+	sessions     sessionStore
+
+	allowlistLock    sync.Mutex
+	allowlist        *allowlist
+	allowlistWatcher *fsnotify.Watcher
+
+	blockedLock     sync.Mutex
+	blockedAttempts map[string]int
+
+	authzLock sync.Mutex
+	authz     *authzWebhook
+
+	policyLock sync.Mutex
+	policy     *accessPolicy
+
+	proxiesLock sync.Mutex
+	proxies     []netip.Prefix
+}
+
+// lockConfig ensures the configuration is not swapped out by a reload while a request is being handled
+func (s *Server) lockConfig(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.configLock.RLock()
+		defer s.configLock.RUnlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reload re-reads the configuration file and applies it to new requests
+func (s *Server) Reload() error {
+	if s.ConfigPath == "" {
+		return errors.New("no configuration file to reload")
+	}
+
+	c, err := readConfig(s.ConfigPath)
+	if err != nil {
+		return err
+	}
+
+	if !validateConfig(c) {
+		return errors.New("configuration validation failed")
+	}
+
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	if !reflect.DeepEqual(c.Server, s.Config.Server) {
+		slog.Warn("Changes to server configuration require a restart to take effect")
+		c.Server = s.Config.Server
+	}
+
+	if c.Sessions.Store != s.Config.Sessions.Store || c.Sessions.Path != s.Config.Sessions.Path {
+		slog.Warn("Changes to session store require a restart to take effect")
+		c.Sessions.Store = s.Config.Sessions.Store
+		c.Sessions.Path = s.Config.Sessions.Path
+	}
+
+	if c.Log.Format != s.Config.Log.Format {
+		slog.Warn("Changes to log format require a restart to take effect")
+	}
+	logLevel.Set(s.configuredLogLevel(c.Log))
+
+	// Reopening the audit log also allows rotating it with a reload
+	keys, err := newKeyRing(*c)
+	if err != nil {
+		return err
+	}
+
+	al, err := loadAllowlist(c.Email)
+	if err != nil {
+		return err
+	}
+
+	policy, err := compilePolicy(c.Policy)
+	if err != nil {
+		return err
+	}
+
+	audit, err := newAuditLog(c.Log.Audit)
+	if err != nil {
+		return err
+	}
+	if err := s.audit.Close(); err != nil {
+		slog.Error("Failed to close audit log", slog.Any("error", err))
+	}
+	s.audit = audit
+
+	s.keysLock.Lock()
+	s.keys = keys
+	s.keysLock.Unlock()
+
+	s.allowlistLock.Lock()
+	s.allowlist = al
+	s.allowlistLock.Unlock()
+	s.watchAllowlist()
+
+	// Decisions cached for the previous webhook configuration are dropped
+	s.authzLock.Lock()
+	s.authz = nil
+	s.authzLock.Unlock()
+
+	s.policyLock.Lock()
+	s.policy = policy
+	s.policyLock.Unlock()
+
+	s.Config = *c
+	s.MailjetSender = nil
+	if s.Config.Mailjet.APIKeyPublic != "" {
+		s.MailjetSender = getMailjetSender(s)
+	}
+
+	return nil
 }
 
 func (s *Server) getRouter() *chi.Mux {
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(middleware.RequestID)
+	r.Use(s.resolveClientIP)
+	r.Use(logRequests)
+	r.Use(measureRequests)
+	r.Use(s.lockConfig)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.NoCache)
 
@@ -49,6 +178,10 @@ func (s *Server) getRouter() *chi.Mux {
 
 	// API Routes
 	registerRoutes(s, r)
+	registerAdminRoutes(s, r)
+	registerSessionRoutes(s, r)
+	registerAccessRoutes(s, r)
+	registerInvitationRoutes(s, r)
 
 	// Embedded frontend build files
 	buildFs, err := fs.Sub(praga.EmbeddedFrontendBuild, "frontend/build")
@@ -56,21 +189,21 @@ func (s *Server) getRouter() *chi.Mux {
 		panic(err)
 	}
 
-	if debug {
-		log.Print("Embedded filesystem to be served as static files:")
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug("Embedded filesystem to be served as static files:")
 		err := fs.WalkDir(buildFs, ".", func(path string, d fs.DirEntry, err error) error {
 			if err != nil {
 				return err
 			}
 			if d.IsDir() {
-				fmt.Printf("%s/\n", path)
+				slog.Debug("Static directory", slog.String("path", path+"/"))
 			} else {
-				println(path)
+				slog.Debug("Static file", slog.String("path", path))
 			}
 			return nil
 		})
 		if err != nil {
-			fmt.Println(err)
+			slog.Debug("Failed to list embedded filesystem", slog.Any("error", err))
 		}
 	}
 
@@ -80,77 +213,166 @@ func (s *Server) getRouter() *chi.Mux {
 	return r
 }
 
-// Start the server
-func (s *Server) Start() {
-	var listener net.Listener
-	var err error
+// Start the server, returning an error if any of the listeners can't be set up or fails while serving
+func (s *Server) Start() error {
+	router := s.getRouter()
 
-	if s.Config.Server.ListenType == "http" {
-		addr := fmt.Sprintf("%s:%d", s.Config.Server.Host, s.Config.Server.Port)
-		listener, err = net.Listen("tcp", addr)
-		if err != nil {
-			log.Panicf("Error trying to listen to %s: %s", addr, err)
+	type listenerServer struct {
+		address  string
+		listener net.Listener
+		server   *http.Server
+	}
+	var servers []listenerServer
+
+	// Closes the listeners opened so far when one of them can't be set up, the sockets are released on return
+	abort := func(err error) error {
+		for _, ls := range servers {
+			if err := ls.listener.Close(); err != nil {
+				slog.Error("Error closing listener", slog.String("address", ls.address), slog.Any("error", err))
+			}
 		}
+		return err
+	}
 
-		log.Printf("Listening to http://%s", addr)
-	} else if s.Config.Server.ListenType == "unix" {
-		// TODO: Test
-		listener, err = net.Listen("unix", s.Config.Server.Socket)
+	// All listeners are opened before serving anything so a broken one does not leave the rest running
+	for _, lc := range s.Config.Server.listenerConfigs() {
+		address := fmt.Sprintf("%s://%s", lc.Type, lc.Address)
+		listener, err := listen(lc)
 		if err != nil {
-			log.Panicf("Error trying to listen to socket %s: %s", s.Config.Server.Socket, err)
+			return abort(fmt.Errorf("listening to %s: %w", address, err))
+		}
+
+		slog.Info("Listening", slog.String("address", address))
+
+		if lc.Type == "unix" {
+			defer releaseSocket(lc.Address)
 		}
 
-		log.Printf("Listening to unix://%s", s.Config.Server.Socket)
+		server := &http.Server{
+			Handler: restrictRoutes(lc.Routes, router),
+		}
+		servers = append(servers, listenerServer{address: address, listener: listener, server: server})
 
-		defer func() {
-			err := os.Remove(s.Config.Server.Socket)
-			if err != nil && os.IsNotExist(err) {
-				log.Printf("Released socket unix://%s\n", s.Config.Server.Socket)
-			} else if err != nil {
-				log.Printf("Error releasing %s: %s\n", s.Config.Server.Socket, err)
+		if lc.Type == "https" {
+			server.TLSConfig, err = newTLSConfig(lc.TLS)
+			if err != nil {
+				return abort(fmt.Errorf("setting up TLS for %s: %w", address, err))
 			}
-		}()
-	} else {
-		log.Panicf("Invalid listen_type %s", s.Config.Server.ListenType)
+		}
 	}
 
-	server := &http.Server{
-		Handler: s.getRouter(),
+	// Any of the servers failing shuts all of them down
+	failed := make(chan error, len(servers))
+	for _, ls := range servers {
+		go func() {
+			var err error
+			if ls.server.TLSConfig != nil {
+				// Certificates come from TLSConfig.GetCertificate
+				err = ls.server.ServeTLS(ls.listener, "", "")
+			} else {
+				err = ls.server.Serve(ls.listener)
+			}
+
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Error from server", slog.String("address", ls.address), slog.Any("error", err))
+				failed <- fmt.Errorf("serving %s: %w", ls.address, err)
+			}
+		}()
 	}
 
-	idleConnsClosed := make(chan struct{})
-	go func() {
-		quitSignal := make(chan os.Signal, 1)
+	watchdogCtx, stopWatchdog := context.WithCancel(context.Background())
+	defer stopWatchdog()
+	go runWatchdog(watchdogCtx)
 
-		// interrupt signal sent from terminal
-		signal.Notify(quitSignal, os.Interrupt)
-		// sigterm signal sent from kubernetes
-		signal.Notify(quitSignal, syscall.SIGTERM)
+	// The listeners are up so we're ready to accept connections
+	notify(sdReady)
 
-		<-quitSignal
+	quitSignal := make(chan os.Signal, 1)
 
-		// We received an interrupt signal, shut down.
-		if err := server.Shutdown(context.Background()); err != nil {
-			// Error from closing listeners, or context timeout:
-			log.Printf("HTTP server Shutdown: %v", err)
-		}
-		close(idleConnsClosed)
-	}()
+	// interrupt signal sent from terminal
+	signal.Notify(quitSignal, os.Interrupt)
+	// sigterm signal sent from kubernetes
+	signal.Notify(quitSignal, syscall.SIGTERM)
+	// sighup signal requests a configuration reload
+	signal.Notify(quitSignal, syscall.SIGHUP)
+
+	var serveErr error
+loop:
+	for {
+		select {
+		case serveErr = <-failed:
+			break loop
+		case sig := <-quitSignal:
+			if sig != syscall.SIGHUP {
+				break loop
+			}
 
-	if err := server.Serve(listener); err != nil {
-		if !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("Error from server: %s\n", err)
+			notify(sdReloading)
+			if err := s.Reload(); err != nil {
+				slog.Error("Failed to reload configuration", slog.Any("error", err))
+			} else {
+				slog.Info("Reloaded configuration", slog.String("path", s.ConfigPath))
+			}
+			notify(sdReady)
 		}
 	}
 
-	<-idleConnsClosed
+	// We received an interrupt signal or a server failed, shut all the servers down together.
+	notify(sdStopping)
+
+	var wg sync.WaitGroup
+	for _, ls := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := ls.server.Shutdown(context.Background()); err != nil {
+				// Error from closing listeners, or context timeout:
+				slog.Error("HTTP server Shutdown", slog.Any("error", err))
+			}
+		}()
+	}
+	wg.Wait()
+
+	s.stopWatchingAllowlist()
+
+	if err := s.audit.Close(); err != nil {
+		slog.Error("Failed to close audit log", slog.Any("error", err))
+	}
+
+	if err := s.sessionStorage().Close(); err != nil {
+		slog.Error("Failed to close session store", slog.Any("error", err))
+	}
+
+	return serveErr
 }
 
-// NewServer creates a new server with this configuration
-func NewServer(config Config) *Server {
+// NewServer creates a new server with this configuration, logging everything at debug level if debug is set
+func NewServer(config Config, debug bool) *Server {
 	s := &Server{
 		Config: config,
+		Debug:  debug,
+	}
+
+	setupLogging(s.Config.Log, s.configuredLogLevel(s.Config.Log))
+
+	audit, err := newAuditLog(s.Config.Log.Audit)
+	if err != nil {
+		log.Fatalf("Error opening audit log %s: %s", s.Config.Log.Audit.Path, err)
+	}
+	s.audit = audit
+
+	sessions, err := newSessionStore(s.Config.Sessions)
+	if err != nil {
+		log.Fatalf("Error opening session store: %s", err)
+	}
+	s.sessions = sessions
+
+	al, err := loadAllowlist(s.Config.Email)
+	if err != nil {
+		log.Fatalf("Error loading allowlist: %s", err)
 	}
+	s.allowlist = al
+	s.watchAllowlist()
 
 	// If mailjet is configured setup the client
 	if s.Config.Mailjet.APIKeyPublic != "" {
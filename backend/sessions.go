@@ -0,0 +1,640 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	bolt "go.etcd.io/bbolt"
+)
+
+// How often expired sessions are cleaned up from the store at most
+const sessionPruneInterval = time.Minute
+
+// sessionInfo is what the session store knows about a login session, only the ID and last use are known unless
+// the session registry is enabled
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email,omitempty"`
+	IssuedAt  time.Time `json:"issued_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Expires   time.Time `json:"expires"`
+}
+
+// sessionStore keeps track of login sessions by their token ID (jti), and also keeps the single-use codes, access
+// requests and the dynamic allowlist
+type sessionStore interface {
+	codeStore
+	accessStore
+
+	// get finds a session, nil if the session is not known or has expired
+	get(id string) (*sessionInfo, error)
+	// put creates or replaces a session
+	put(session *sessionInfo) error
+	// update changes a session that is known and has not expired, in one step so a session removed in the meantime
+	// is not brought back, reporting if the session was found
+	update(id string, change func(session *sessionInfo)) (bool, error)
+	// list gets the sessions of the email that have not expired
+	list(email string) ([]*sessionInfo, error)
+	// remove forgets a session, doing nothing if it is not known
+	remove(id string) error
+	Close() error
+}
+
+// memorySessionStore keeps sessions in memory, they are forgotten on restart
+type memorySessionStore struct {
+	lock      sync.RWMutex
+	sessions  map[string]sessionInfo
+	codes     map[string][]issuedCode
+	lastPrune time.Time
+
+	accessRequests map[string]accessRequest
+	accessGrants   map[string]accessGrant
+	// The expiry of the links of the used and cancelled invitations
+	closedInvitations map[string]time.Time
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions:  map[string]sessionInfo{},
+		codes:     map[string][]issuedCode{},
+		lastPrune: time.Now(),
+
+		accessRequests:    map[string]accessRequest{},
+		accessGrants:      map[string]accessGrant{},
+		closedInvitations: map[string]time.Time{},
+	}
+}
+
+func (ms *memorySessionStore) get(id string) (*sessionInfo, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	session, ok := ms.sessions[id]
+	if !ok || time.Now().After(session.Expires) {
+		return nil, nil
+	}
+	return &session, nil
+}
+
+func (ms *memorySessionStore) put(session *sessionInfo) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	ms.sessions[session.ID] = *session
+
+	now := time.Now()
+	if now.Sub(ms.lastPrune) >= sessionPruneInterval {
+		for id, s := range ms.sessions {
+			if now.After(s.Expires) {
+				delete(ms.sessions, id)
+			}
+		}
+		for email, codes := range ms.codes {
+			if codesExpired(codes, now) {
+				delete(ms.codes, email)
+			}
+		}
+		for id, request := range ms.accessRequests {
+			if now.After(request.Expires) {
+				delete(ms.accessRequests, id)
+			}
+		}
+		for id, expires := range ms.closedInvitations {
+			if now.After(expires) {
+				delete(ms.closedInvitations, id)
+			}
+		}
+		ms.lastPrune = now
+	}
+
+	return nil
+}
+
+func (ms *memorySessionStore) update(id string, change func(session *sessionInfo)) (bool, error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	session, ok := ms.sessions[id]
+	if !ok || time.Now().After(session.Expires) {
+		return false, nil
+	}
+
+	change(&session)
+	ms.sessions[id] = session
+	return true, nil
+}
+
+func (ms *memorySessionStore) list(email string) ([]*sessionInfo, error) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+
+	now := time.Now()
+	var sessions []*sessionInfo
+	for _, s := range ms.sessions {
+		if s.Email == email && !now.After(s.Expires) {
+			session := s
+			sessions = append(sessions, &session)
+		}
+	}
+	return sessions, nil
+}
+
+func (ms *memorySessionStore) remove(id string) error {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	delete(ms.sessions, id)
+	return nil
+}
+
+func (ms *memorySessionStore) Close() error {
+	return nil
+}
+
+var sessionsBucket = []byte("sessions")
+
+// fileSessionStore keeps sessions in a BoltDB file so they survive restarts
+type fileSessionStore struct {
+	db *bolt.DB
+
+	lock      sync.Mutex
+	lastPrune time.Time
+}
+
+func newFileSessionStore(path string) (*fileSessionStore, error) {
+	// Only one process can have the file open, fail instead of hanging if another one does
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{sessionsBucket, codesBucket, accessRequestsBucket, accessGrantsBucket, closedInvitationsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &fileSessionStore{db: db}, nil
+}
+
+func (fs *fileSessionStore) get(id string) (*sessionInfo, error) {
+	var session *sessionInfo
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(sessionsBucket).Get([]byte(id))
+		if value == nil {
+			return nil
+		}
+
+		session = &sessionInfo{}
+		return json.Unmarshal(value, session)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if session == nil || time.Now().After(session.Expires) {
+		return nil, nil
+	}
+	return session, nil
+}
+
+func (fs *fileSessionStore) put(session *sessionInfo) error {
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	err = fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(session.ID), value)
+	})
+	if err != nil {
+		return err
+	}
+
+	return fs.prune()
+}
+
+func (fs *fileSessionStore) update(id string, change func(session *sessionInfo)) (bool, error) {
+	found := false
+	err := fs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+
+		session := &sessionInfo{}
+		var err error
+		found, err = getJSON(bucket, id, session)
+		if err != nil || !found {
+			return err
+		}
+		if time.Now().After(session.Expires) {
+			found = false
+			return nil
+		}
+
+		change(session)
+		return putJSON(bucket, id, session)
+	})
+	return found, err
+}
+
+// prune deletes expired sessions, at most every sessionPruneInterval
+func (fs *fileSessionStore) prune() error {
+	fs.lock.Lock()
+	now := time.Now()
+	if now.Sub(fs.lastPrune) < sessionPruneInterval {
+		fs.lock.Unlock()
+		return nil
+	}
+	fs.lastPrune = now
+	fs.lock.Unlock()
+
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		var expired [][]byte
+
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			session := sessionInfo{}
+			if err := json.Unmarshal(value, &session); err != nil || now.After(session.Expires) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		codes := tx.Bucket(codesBucket)
+		expired = nil
+		err = codes.ForEach(func(key []byte, value []byte) error {
+			var issued []issuedCode
+			if err := json.Unmarshal(value, &issued); err != nil || codesExpired(issued, now) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := codes.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		requests := tx.Bucket(accessRequestsBucket)
+		expired = nil
+		err = requests.ForEach(func(key []byte, value []byte) error {
+			request := accessRequest{}
+			if err := json.Unmarshal(value, &request); err != nil || now.After(request.Expires) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := requests.Delete(key); err != nil {
+				return err
+			}
+		}
+
+		invitations := tx.Bucket(closedInvitationsBucket)
+		expired = nil
+		err = invitations.ForEach(func(key []byte, value []byte) error {
+			var expires time.Time
+			if err := json.Unmarshal(value, &expires); err != nil || now.After(expires) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			if err := invitations.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (fs *fileSessionStore) list(email string) ([]*sessionInfo, error) {
+	now := time.Now()
+	var sessions []*sessionInfo
+
+	err := fs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).ForEach(func(_ []byte, value []byte) error {
+			session := &sessionInfo{}
+			if err := json.Unmarshal(value, session); err != nil {
+				return err
+			}
+
+			if session.Email == email && !now.After(session.Expires) {
+				sessions = append(sessions, session)
+			}
+			return nil
+		})
+	})
+
+	return sessions, err
+}
+
+func (fs *fileSessionStore) remove(id string) error {
+	return fs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(id))
+	})
+}
+
+func (fs *fileSessionStore) Close() error {
+	return fs.db.Close()
+}
+
+// newSessionStore creates the configured session store
+func newSessionStore(config SessionsConfig) (sessionStore, error) {
+	switch config.Store {
+	case "", "memory":
+		return newMemorySessionStore(), nil
+	case "file":
+		return newFileSessionStore(config.Path)
+	}
+	return nil, fmt.Errorf("unsupported sessions.store %s", config.Store)
+}
+
+// sessionStorage gets the session store, created on first use
+func (s *Server) sessionStorage() sessionStore {
+	s.sessionsLock.Lock()
+	defer s.sessionsLock.Unlock()
+
+	if s.sessions == nil {
+		sessions, err := newSessionStore(s.Config.Sessions)
+		if err != nil {
+			// The store is opened when starting the server so this should never happen
+			panic(err)
+		}
+		s.sessions = sessions
+	}
+
+	return s.sessions
+}
+
+// registerSession records a new login session in the session registry, if enabled
+func registerSession(srv *Server, r *http.Request, email string, session tokenSession, expires time.Time) error {
+	if !srv.Config.Sessions.Registry {
+		return nil
+	}
+
+	return srv.sessionStorage().put(&sessionInfo{
+		ID:        session.id,
+		Email:     email,
+		IssuedAt:  session.authTime,
+		LastSeen:  session.authTime,
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+		Expires:   expires,
+	})
+}
+
+// extendSession keeps a refreshed session in the session registry until the new token expires
+func extendSession(srv *Server, id string, expires time.Time) error {
+	if !srv.Config.Sessions.Registry {
+		return nil
+	}
+
+	_, err := srv.sessionStorage().update(id, func(session *sessionInfo) {
+		session.Expires = expires
+	})
+	return err
+}
+
+// userSessions gets the active sessions of the email, newest first
+func userSessions(srv *Server, email string) ([]*sessionInfo, error) {
+	sessions, err := srv.sessionStorage().list(email)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].IssuedAt.After(sessions[j].IssuedAt)
+	})
+	return sessions, nil
+}
+
+// checkSession rejects sessions that have been revoked or have not been used within the idle timeout, and
+// records the session being used. To keep the write rate down the last use is only updated every
+// sessions.touch_interval_seconds.
+func checkSession(srv *Server, claims *tokenClaims) error {
+	registry := srv.Config.Sessions.Registry
+	idleTimeout := time.Duration(srv.Config.Sessions.IdleTimeoutSeconds) * time.Second
+	if !registry && idleTimeout == 0 {
+		return nil
+	}
+
+	if claims.ID == "" {
+		return errors.New("token has no session ID")
+	}
+
+	store := srv.sessionStorage()
+	now := time.Now()
+
+	session, err := store.get(claims.ID)
+	if err != nil {
+		return fmt.Errorf("error getting session: %w", err)
+	}
+
+	known := session != nil
+	if !known {
+		// Sessions are registered on login, so unknown ones have been revoked
+		if registry {
+			return errors.New("session not found in the session registry")
+		}
+
+		// Without the registry unknown sessions have not been used since the token was issued, the file store
+		// keeps the activity over restarts
+		session = &sessionInfo{ID: claims.ID, LastSeen: now}
+		if claims.IssuedAt != nil {
+			session.LastSeen = claims.IssuedAt.Time
+		}
+	}
+
+	if idleTimeout > 0 && now.Sub(session.LastSeen) > idleTimeout {
+		return fmt.Errorf("%w: session idle for too long", jwt.ErrTokenExpired)
+	}
+
+	touchInterval := time.Duration(srv.Config.Sessions.TouchIntervalSeconds) * time.Second
+	if known && now.Sub(session.LastSeen) < touchInterval {
+		return nil
+	}
+
+	touch := func(session *sessionInfo) {
+		session.LastSeen = now
+		if !registry {
+			session.Expires = now.Add(idleTimeout)
+		}
+	}
+
+	if !known {
+		touch(session)
+		if err := store.put(session); err != nil {
+			return fmt.Errorf("error recording session use: %w", err)
+		}
+		return nil
+	}
+
+	// The session may have been revoked since it was read, which must not be undone
+	updated, err := store.update(claims.ID, touch)
+	if err != nil {
+		return fmt.Errorf("error recording session use: %w", err)
+	}
+	if !updated && registry {
+		return errors.New("session not found in the session registry")
+	}
+	return nil
+}
+
+// revokeSession ends a session by removing it from the session registry, if enabled
+func revokeSession(srv *Server, id string) error {
+	if !srv.Config.Sessions.Registry || id == "" {
+		return nil
+	}
+	return srv.sessionStorage().remove(id)
+}
+
+// currentSession gets the claims of the logged in user making the request
+func currentSession(srv *Server, r *http.Request) (*tokenClaims, bool) {
+	token, err := r.Cookie(srv.Config.CookieAuth.CookieName)
+	if err != nil {
+		return nil, false
+	}
+
+	claims, err := validateToken(srv, token.Value)
+	if err == nil {
+		err = checkClientBinding(srv, r, claims)
+	}
+	if err == nil {
+		err = checkSession(srv, claims)
+	}
+	if err != nil {
+		slog.DebugContext(r.Context(), "Session check failed", slog.Any("error", err))
+		return nil, false
+	}
+
+	return claims, true
+}
+
+// requireSessionRegistry only lets logged in users through when the session registry is enabled
+func requireSessionRegistry(srv *Server) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !srv.Config.Sessions.Registry {
+				http.NotFound(w, r)
+				return
+			}
+
+			claims, ok := currentSession(srv, r)
+			if !ok {
+				authFailed(w)
+				return
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims)))
+		})
+	}
+}
+
+type claimsContextKey struct{}
+
+func registerSessionRoutes(srv *Server, r *chi.Mux) {
+	r.Route("/api/sessions", func(r chi.Router) {
+		r.Use(requireSessionRegistry(srv))
+
+		// List the active sessions of the logged in user
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			claims := r.Context().Value(claimsContextKey{}).(*tokenClaims)
+
+			sessions, err := userSessions(srv, claims.Subject)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error listing sessions", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			res := sessionsResponse{Email: claims.Subject, Sessions: []sessionResponse{}}
+			for _, session := range sessions {
+				res.Sessions = append(res.Sessions, sessionResponse{
+					ID:        session.ID,
+					IssuedAt:  session.IssuedAt,
+					LastSeen:  session.LastSeen,
+					IP:        session.IP,
+					UserAgent: session.UserAgent,
+					Current:   session.ID == claims.ID,
+				})
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(res); err != nil {
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+			}
+		})
+
+		// Revoke one of the sessions of the logged in user
+		r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) {
+			claims := r.Context().Value(claimsContextKey{}).(*tokenClaims)
+			id := chi.URLParam(r, "id")
+
+			store := srv.sessionStorage()
+			session, err := store.get(id)
+			if err != nil {
+				slog.ErrorContext(r.Context(), "Error getting session", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			// Don't reveal whether other users' sessions exist
+			if session == nil || session.Email != claims.Subject {
+				http.NotFound(w, r)
+				return
+			}
+
+			if err := store.remove(id); err != nil {
+				slog.ErrorContext(r.Context(), "Error revoking session", slog.Any("error", err))
+				http.Error(w, "Internal error", http.StatusInternalServerError)
+				return
+			}
+
+			srv.audit.record(r, auditSessionRevoked, claims.Subject, slog.String("session", id))
+
+			if id == claims.ID {
+				clearAuthCookie(srv, w)
+			}
+			w.WriteHeader(204)
+		})
+	})
+}
@@ -0,0 +1,179 @@
+package backend
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testSessionStore(t *testing.T, store sessionStore) {
+	now := time.Now()
+
+	if session, err := store.get("missing"); err != nil || session != nil {
+		t.Errorf("Got %v, %v for unknown session", session, err)
+	}
+
+	sessions := []*sessionInfo{
+		{ID: "expired", Email: "user@example.com", IssuedAt: now.Add(-2 * time.Hour), Expires: now.Add(-time.Minute)},
+		{ID: "old", Email: "user@example.com", IssuedAt: now.Add(-time.Hour), Expires: now.Add(time.Hour)},
+		{ID: "new", Email: "user@example.com", IssuedAt: now, LastSeen: now, IP: "192.0.2.1", Expires: now.Add(time.Hour)},
+		{ID: "other", Email: "other@example.com", IssuedAt: now, Expires: now.Add(time.Hour)},
+	}
+	for _, session := range sessions {
+		if err := store.put(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if session, _ := store.get("expired"); session != nil {
+		t.Error("Expired session was found")
+	}
+
+	session, err := store.get("new")
+	if err != nil || session == nil || session.IP != "192.0.2.1" || !session.LastSeen.Equal(now) {
+		t.Errorf("Got %v, %v for new session", session, err)
+	}
+
+	found, err := store.list("user@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Errorf("Listed %d sessions, expected 2", len(found))
+	}
+
+	// Updates only change sessions that are still there
+	later := now.Add(time.Minute)
+	touch := func(session *sessionInfo) { session.LastSeen = later }
+	if updated, err := store.update("new", touch); err != nil || !updated {
+		t.Errorf("Got %v, %v updating session", updated, err)
+	}
+	if session, _ := store.get("new"); session == nil || !session.LastSeen.Equal(later) || session.IP != "192.0.2.1" {
+		t.Errorf("Got %v for updated session", session)
+	}
+	if updated, err := store.update("expired", touch); err != nil || updated {
+		t.Errorf("Got %v, %v updating expired session", updated, err)
+	}
+
+	if err := store.remove("new"); err != nil {
+		t.Fatal(err)
+	}
+	if session, _ := store.get("new"); session != nil {
+		t.Error("Removed session was found")
+	}
+	if updated, err := store.update("new", touch); err != nil || updated {
+		t.Errorf("Got %v, %v updating removed session", updated, err)
+	}
+	if session, _ := store.get("new"); session != nil {
+		t.Error("Updating removed session brought it back")
+	}
+
+	// Single-use codes
+	if err := store.addCode("user@example.com", "hash", now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if used, err := store.useCode("other@example.com", "hash"); err != nil || used {
+		t.Errorf("Got %v, %v using another email's code", used, err)
+	}
+	if used, err := store.useCode("user@example.com", "hash"); err != nil || !used {
+		t.Errorf("Got %v, %v using issued code", used, err)
+	}
+	if used, err := store.useCode("user@example.com", "hash"); err != nil || used {
+		t.Errorf("Got %v, %v using code again", used, err)
+	}
+
+	// Access requests are only taken once
+	request := &accessRequest{ID: "request", Email: "guest@example.org", Reason: "Audit", Created: now, Expires: now.Add(time.Hour)}
+	if err := store.putAccessRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.putAccessRequest(&accessRequest{ID: "expired", Expires: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := store.getAccessRequest("request"); err != nil || found == nil || found.Reason != "Audit" {
+		t.Errorf("Got %v, %v for access request", found, err)
+	}
+	if found, err := store.getAccessRequest("expired"); err != nil || found != nil {
+		t.Errorf("Got %v, %v for expired access request", found, err)
+	}
+	if found, err := store.takeAccessRequest("request"); err != nil || found == nil {
+		t.Errorf("Got %v, %v taking access request", found, err)
+	}
+	if found, err := store.takeAccessRequest("request"); err != nil || found != nil {
+		t.Errorf("Got %v, %v taking access request again", found, err)
+	}
+
+	// Dynamic allowlist
+	if grant, err := store.getAccessGrant("guest@example.org"); err != nil || grant != nil {
+		t.Errorf("Got %v, %v for unknown access grant", grant, err)
+	}
+	if err := store.putAccessGrant(&accessGrant{Email: "guest@example.org", GrantedBy: "admin@example.com", Granted: now}); err != nil {
+		t.Fatal(err)
+	}
+	if grant, err := store.getAccessGrant("guest@example.org"); err != nil || grant == nil || grant.GrantedBy != "admin@example.com" {
+		t.Errorf("Got %v, %v for access grant", grant, err)
+	}
+	if grants, err := store.listAccessGrants(); err != nil || len(grants) != 1 {
+		t.Errorf("Got %v, %v listing access grants", grants, err)
+	}
+
+	// Invitations are only closed once
+	if closed, err := store.invitationClosed("invitation"); err != nil || closed {
+		t.Errorf("Got %v, %v for open invitation", closed, err)
+	}
+	if closed, err := store.closeInvitation("invitation", now.Add(time.Hour)); err != nil || closed {
+		t.Errorf("Got %v, %v closing open invitation", closed, err)
+	}
+	if closed, err := store.closeInvitation("invitation", now.Add(time.Hour)); err != nil || !closed {
+		t.Errorf("Got %v, %v closing closed invitation", closed, err)
+	}
+	if closed, err := store.invitationClosed("invitation"); err != nil || !closed {
+		t.Errorf("Got %v, %v for closed invitation", closed, err)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemorySessionStore(t *testing.T) {
+	testSessionStore(t, newMemorySessionStore())
+
+	// Expired sessions are cleaned up once the prune interval has passed
+	store := newMemorySessionStore()
+	now := time.Now()
+	if err := store.put(&sessionInfo{ID: "expired", Expires: now.Add(-time.Minute)}); err != nil {
+		t.Fatal(err)
+	}
+
+	store.lastPrune = now.Add(-sessionPruneInterval)
+	if err := store.put(&sessionInfo{ID: "active", Expires: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.sessions["expired"]; ok {
+		t.Error("Expired session was not pruned")
+	}
+	if _, ok := store.sessions["active"]; !ok {
+		t.Error("Active session was pruned")
+	}
+}
+
+func TestFileSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.db")
+	store, err := newFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSessionStore(t, store)
+
+	// Sessions survive reopening the file
+	store, err = newFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if session, err := store.get("old"); err != nil || session == nil {
+		t.Errorf("Got %v, %v for session after reopening", session, err)
+	}
+}
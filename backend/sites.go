@@ -0,0 +1,98 @@
+package backend
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// stripPort removes the port from a host, if there is one
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// siteAudience finds the audience of the protected site for the host, false if the host is not configured
+func siteAudience(srv *Server, host string) (string, bool) {
+	host = strings.ToLower(stripPort(host))
+	for _, site := range srv.Config.Sites {
+		if strings.ToLower(site.Host) == host {
+			if site.Audience != "" {
+				return site.Audience, true
+			}
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// targetAudience finds the audience for the URL the user is being redirected to after login
+func targetAudience(srv *Server, target string) (string, bool) {
+	if target == "" {
+		return "", false
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+
+	return siteAudience(srv, u.Host)
+}
+
+// originalHost gets the host the user is accessing through Nginx, as forwarded to /api/verify-token
+func originalHost(r *http.Request) string {
+	return r.Header.Get("X-Forwarded-Host")
+}
+
+// originalPath gets the path the user is accessing through Nginx, as forwarded to /api/verify-token, false if it
+// was not forwarded. The path is decoded and cleaned the way Nginx and upstreams resolve it, so e.g.
+// /public/../admin or //admin can't get past rules written for /admin.
+func originalPath(r *http.Request) (string, bool) {
+	uri := r.Header.Get("X-Original-URI")
+	if uri == "" {
+		return "", false
+	}
+
+	// Not parsed as a URL, which would take the start of e.g. //admin as the host
+	rawPath, _, _ := strings.Cut(uri, "?")
+	p, err := url.PathUnescape(rawPath)
+	if err != nil || !strings.HasPrefix(p, "/") {
+		return "", false
+	}
+
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned, true
+}
+
+// originalMethod gets the method the user is accessing with through Nginx, false if it was not forwarded
+func originalMethod(r *http.Request) (string, bool) {
+	method := r.Header.Get("X-Original-Method")
+	return method, method != ""
+}
+
+// tokenAudiences works out the audiences for a new token, keeping those of a still valid previous token so
+// logging in to another site does not log the user out from the previous ones
+func tokenAudiences(srv *Server, r *http.Request, email string, target string) []string {
+	var audiences []string
+
+	if cookie, err := r.Cookie(srv.Config.CookieAuth.CookieName); err == nil {
+		if claims, err := validateToken(srv, cookie.Value); err == nil && claims.Subject == email {
+			audiences = append(audiences, claims.Audience...)
+		}
+	}
+
+	if audience, ok := targetAudience(srv, target); ok && !slices.Contains(audiences, audience) {
+		audiences = append(audiences, audience)
+	}
+
+	return audiences
+}
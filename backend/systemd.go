@@ -0,0 +1,95 @@
+package backend
+
+/*
+ * Minimal implementation of the systemd notification protocol, see sd_notify(3). Speaks directly to
+ * the NOTIFY_SOCKET datagram socket so there is no need for libsystemd or cgo.
+ */
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	sdReady     = "READY=1"
+	sdStopping  = "STOPPING=1"
+	sdWatchdog  = "WATCHDOG=1"
+	sdReloading = "RELOADING=1"
+)
+
+// sdNotify sends the given state to systemd, does nothing when not started by systemd
+func sdNotify(state string) error {
+	socketPath := os.Getenv("NOTIFY_SOCKET")
+	if socketPath == "" {
+		return nil
+	}
+
+	// Abstract namespace sockets are given with a leading @
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// notify sends a state update to systemd and logs any failures
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		slog.Warn("Failed to notify systemd", slog.String("state", state), slog.Any("error", err))
+	}
+}
+
+// sdWatchdogInterval returns how often systemd expects watchdog pings, 0 if the watchdog is not enabled
+func sdWatchdogInterval() time.Duration {
+	usecStr := os.Getenv("WATCHDOG_USEC")
+	if usecStr == "" {
+		return 0
+	}
+
+	// The watchdog may be meant for a different process e.g. when started via a wrapper
+	pidStr := os.Getenv("WATCHDOG_PID")
+	if pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		if err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+
+	usec, err := strconv.ParseInt(usecStr, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// runWatchdog keeps pinging the systemd watchdog at half the configured interval until ctx is done
+func runWatchdog(ctx context.Context) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			notify(sdWatchdog)
+		}
+	}
+}
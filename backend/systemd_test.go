@@ -0,0 +1,62 @@
+package backend
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSdNotify(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	if err := sdNotify(sdReady); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(buf[:n]) != sdReady {
+		t.Errorf("Received %q, expected %q", string(buf[:n]), sdReady)
+	}
+}
+
+func TestSdNotifyNoSocket(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify(sdReady); err != nil {
+		t.Errorf("Expected no error without NOTIFY_SOCKET, got %s", err)
+	}
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	if interval := sdWatchdogInterval(); interval != 30*time.Second {
+		t.Errorf("Watchdog interval %s, expected 30s", interval)
+	}
+
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	if interval := sdWatchdogInterval(); interval != 0 {
+		t.Errorf("Watchdog for another process should be disabled, got %s", interval)
+	}
+
+	t.Setenv("WATCHDOG_USEC", "")
+	if interval := sdWatchdogInterval(); interval != 0 {
+		t.Errorf("Watchdog should be disabled without WATCHDOG_USEC, got %s", interval)
+	}
+}
@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// How often to check the certificate files for changes at most
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a certificate from disk, reloading it when the files change e.g. on certbot renewals
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	lock      sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	lastCheck time.Time
+}
+
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// modTimes gets the last modification times of the certificate and key files
+func (cr *certReloader) modTimes() (time.Time, time.Time, error) {
+	certStat, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	keyStat, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
+	return certStat.ModTime(), keyStat.ModTime(), nil
+}
+
+// load reads the certificate and key from disk, must be called with the lock held or before use
+func (cr *certReloader) load() error {
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.cert = &cert
+	cr.certMod = certMod
+	cr.keyMod = keyMod
+	cr.lastCheck = time.Now()
+	return nil
+}
+
+// GetCertificate returns the current certificate, checking for updated files every certCheckInterval
+func (cr *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+
+	if time.Since(cr.lastCheck) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.lastCheck = time.Now()
+
+	certMod, keyMod, err := cr.modTimes()
+	if err != nil {
+		slog.Error("Failed to check certificate for changes", slog.String("file", cr.certFile), slog.Any("error", err))
+		return cr.cert, nil
+	}
+
+	if certMod.Equal(cr.certMod) && keyMod.Equal(cr.keyMod) {
+		return cr.cert, nil
+	}
+
+	// Keep serving the previous certificate if the new one is broken, e.g. only half written
+	if err := cr.load(); err != nil {
+		slog.Error("Failed to reload certificate", slog.String("file", cr.certFile), slog.Any("error", err))
+		return cr.cert, nil
+	}
+
+	slog.Info("Reloaded certificate", slog.String("file", cr.certFile))
+	return cr.cert, nil
+}
+
+// newTLSConfig builds the TLS configuration for the https listen type with modern defaults
+func newTLSConfig(config TLSConfig) (*tls.Config, error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("tls.cert_file and tls.key_file are required for https")
+	}
+
+	reloader, err := newCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading certificate %s: %w", config.CertFile, err)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		GetCertificate:   reloader.GetCertificate,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256, tls.CurveP384},
+		// Only used for TLS 1.2, TLS 1.3 suites are not configurable and all fine
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+
+	// Require clients to present a certificate signed by the CA, e.g. for a remote Nginx
+	if config.ClientCAFile != "" {
+		caPEM, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading client CA %s: %w", config.ClientCAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", config.ClientCAFile)
+		}
+
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
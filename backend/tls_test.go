@@ -0,0 +1,108 @@
+package backend
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a new self-signed certificate and key with the given serial number
+func writeTestCertificate(t *testing.T, certFile string, keyFile string, serial int64) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writeTestCertificate(t, certFile, keyFile, 1)
+
+	reloader, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := reloader.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := cert.Certificate[0]
+
+	// Renew the certificate and make sure it looks modified
+	writeTestCertificate(t, certFile, keyFile, 2)
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ = reloader.GetCertificate(nil)
+	if string(cert.Certificate[0]) != string(first) {
+		t.Error("Certificate was reloaded before the check interval")
+	}
+
+	reloader.lastCheck = time.Now().Add(-certCheckInterval)
+	cert, _ = reloader.GetCertificate(nil)
+	if string(cert.Certificate[0]) == string(first) {
+		t.Error("Certificate was not reloaded after changing on disk")
+	}
+
+	// Broken files should keep the previous certificate in use
+	if err := os.WriteFile(certFile, []byte("broken"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	if err := os.Chtimes(certFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	reloader.lastCheck = time.Now().Add(-certCheckInterval)
+	cert, err = reloader.GetCertificate(nil)
+	if err != nil || cert == nil {
+		t.Errorf("Expected previous certificate to be kept, got %v", err)
+	}
+}
+
+func TestNewTLSConfigRequiresCertificate(t *testing.T) {
+	if _, err := newTLSConfig(TLSConfig{}); err == nil {
+		t.Error("Expected error without certificate files")
+	}
+}
@@ -2,40 +2,204 @@ package backend
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"crypto/subtle"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
 	"strings"
 	"time"
+	"unicode"
 )
 
 // Set of easily distinguishable characters
 // const CODE_CHARS = "23579CDFHJKLMNPQRSTVWXYZ"
 
+// Defaults for the code format
 const (
-	CodeChars  = "2379HJKLNQSTVXYZ" // Limited to a nice even 16 options
-	timeChunks = time.Duration(15) * time.Minute
-	hashLen    = 8
+	CodeChars          = "2379HJKLNQSTVXYZ" // Limited to a nice even 16 options
+	timeChunks         = time.Duration(15) * time.Minute
+	hashLen            = 8
+	defaultValidWindow = 2
 )
 
-// / encodeBytes Generates easy human-readable strings out of input bytes
-func encodeBytes(input []byte) string {
-	result := ""
+// Codes must have at least this many bits of entropy, taking into account all the codes accepted at once
+const minCodeBits = 24
+
+// codeFormat describes what the verification codes look like and how long they are valid for
+type codeFormat struct {
+	alphabet string
+	length   int
+	window   time.Duration
+	// How many time windows a code is accepted in, including the current one
+	validWindows int
+}
+
+var defaultCodeFormat = codeFormat{
+	alphabet:     CodeChars,
+	length:       hashLen,
+	window:       timeChunks,
+	validWindows: defaultValidWindow,
+}
+
+// newCodeFormat creates the code format from the configuration, using the defaults for anything not set
+func newCodeFormat(config CodeConfig) codeFormat {
+	format := defaultCodeFormat
+	if config.Alphabet != "" {
+		format.alphabet = config.Alphabet
+	}
+	if config.Length != 0 {
+		format.length = config.Length
+	}
+	if config.WindowMinutes != 0 {
+		format.window = time.Duration(config.WindowMinutes) * time.Minute
+	}
+	if config.ValidWindows != 0 {
+		format.validWindows = config.ValidWindows
+	}
+	return format
+}
+
+// check ensures the format makes sense and the codes are not too easy to guess
+func (f codeFormat) check() error {
+	seen := map[rune]bool{}
+	for _, char := range f.alphabet {
+		if char > unicode.MaxASCII || !unicode.IsPrint(char) || unicode.IsSpace(char) || unicode.IsLower(char) {
+			return fmt.Errorf("code alphabet can only contain printable ASCII characters that are not lowercase, got %q", char)
+		}
+		if seen[char] {
+			return fmt.Errorf("code alphabet contains %q more than once", char)
+		}
+		seen[char] = true
+	}
+
+	if len(f.alphabet) < 2 {
+		return errors.New("code alphabet needs at least 2 characters")
+	}
+
+	if f.validWindows < 2 {
+		return errors.New("codes need at least 2 valid windows, so codes sent at the end of a window can still be used")
+	}
+
+	if f.bits() < minCodeBits {
+		return fmt.Errorf("codes of %d characters out of %d with %d valid windows are too easy to guess, %.1f bits of the required %d",
+			f.length, len(f.alphabet), f.validWindows, f.bits(), minCodeBits)
+	}
+
+	return nil
+}
+
+// bits gives the entropy of the codes, reduced by the number of codes accepted at the same time
+func (f codeFormat) bits() float64 {
+	return float64(f.length)*math.Log2(float64(len(f.alphabet))) - math.Log2(float64(f.validWindows))
+}
+
+// validity is how long a code can be used for at most
+func (f codeFormat) validity() time.Duration {
+	return f.window * time.Duration(f.validWindows)
+}
+
+// minValidity is how long a code can be used for at least, as codes can be sent at the end of a window
+func (f codeFormat) minValidity() time.Duration {
+	return f.window * time.Duration(f.validWindows-1)
+}
+
+// normalize prepares user input for comparing to codes
+func (f codeFormat) normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
 
-	for _, value := range input {
-		left := value >> 4
-		right := value & 0b00001111
-		valueStr := CodeChars[left:left+1] + CodeChars[right:right+1]
-		result += valueStr
+// valid checks the code could be in this format, without checking it is correct
+func (f codeFormat) valid(code string) bool {
+	code = f.normalize(code)
+	if len(code) != f.length {
+		return false
 	}
 
-	return result
+	for _, char := range code {
+		if !strings.ContainsRune(f.alphabet, char) {
+			return false
+		}
+	}
+	return true
+}
+
+// encode generates easy human-readable strings out of input bytes. Power of two alphabets take the bits of the
+// input in order, so each character of a 16 character alphabet is half a byte. Others would not divide the bits
+// evenly so the input is converted to the base of the alphabet as a number.
+func (f codeFormat) encode(input []byte) string {
+	base := len(f.alphabet)
+
+	if base&(base-1) == 0 {
+		bitsPerChar := bits.TrailingZeros(uint(base))
+		result := make([]byte, 0, len(input)*8/bitsPerChar)
+
+		var buffer uint
+		buffered := 0
+		for _, value := range input {
+			buffer = buffer<<8 | uint(value)
+			buffered += 8
+			for buffered >= bitsPerChar {
+				buffered -= bitsPerChar
+				result = append(result, f.alphabet[(buffer>>buffered)&uint(base-1)])
+			}
+		}
+		return string(result)
+	}
+
+	number := new(big.Int).SetBytes(input)
+	bigBase := big.NewInt(int64(base))
+	digit := new(big.Int)
+
+	result := make([]byte, f.length)
+	for i := range result {
+		number.DivMod(number, bigBase, digit)
+		result[i] = f.alphabet[digit.Int64()]
+	}
+	return string(result)
+}
+
+// make creates the code for the email in the time window of the timestamp
+func (f codeFormat) make(signingKey string, email string, timestamp time.Time) string {
+	payload := fmt.Sprintf("%s | %s", email, timestamp.Truncate(f.window).String())
+	hash := getHash(signingKey, payload)
+	return f.encode(hash)[:f.length]
+}
+
+// random creates a code that is not derived from the email, for single-use codes kept on the server
+func (f codeFormat) random() (string, error) {
+	result := make([]byte, f.length)
+	max := big.NewInt(int64(len(f.alphabet)))
+	for i := range result {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		result[i] = f.alphabet[n.Int64()]
+	}
+	return string(result), nil
+}
+
+// verify checks the code matches the one for the email in the current or previous valid time windows
+func (f codeFormat) verify(code string, signingKey string, email string, timestamp time.Time) bool {
+	code = f.normalize(code)
+
+	match := false
+	for i := 0; i < f.validWindows; i++ {
+		expected := f.make(signingKey, email, timestamp.Add(-f.window*time.Duration(i)))
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			match = true
+		}
+	}
+	return match
 }
 
-// / getTimeChunk Gets a neat timestamp string of the chunk of time the given time belongs to
-func getTimeChunk(t time.Time) string {
-	// Truncate to chunk
-	return t.Truncate(timeChunks).String()
+// / encodeBytes Generates easy human-readable strings out of input bytes
+func encodeBytes(input []byte) string {
+	return defaultCodeFormat.encode(input)
 }
 
 // / getHash Produce a strong hash unique to the signing key and value
@@ -47,9 +211,7 @@ func getHash(signingKey string, value string) []byte {
 }
 
 func MakeVerifyCodeTS(signingKey string, email string, timestamp time.Time) string {
-	payload := fmt.Sprintf("%s | %s", email, getTimeChunk(timestamp))
-	hash := getHash(signingKey, payload)
-	return encodeBytes(hash[:hashLen])[:hashLen]
+	return defaultCodeFormat.make(signingKey, email, timestamp)
 }
 
 func MakeVerifyCodeNow(signingKey string, email string) string {
@@ -57,21 +219,7 @@ func MakeVerifyCodeNow(signingKey string, email string) string {
 }
 
 func CheckVerifyCodeTS(token string, signingKey string, email string, timestamp time.Time) bool {
-	token = strings.ToUpper(token)
-	currentExpected := MakeVerifyCodeTS(signingKey, email, timestamp)
-	previousExpected := MakeVerifyCodeTS(signingKey, email, timestamp.Add(-timeChunks))
-
-	match := false
-
-	if subtle.ConstantTimeCompare([]byte(token), []byte(currentExpected)) == 1 {
-		match = true
-	}
-
-	if subtle.ConstantTimeCompare([]byte(token), []byte(previousExpected)) == 1 {
-		match = true
-	}
-
-	return match
+	return defaultCodeFormat.verify(token, signingKey, email, timestamp)
 }
 
 func CheckVerifyCode(token string, signingKey string, email string) bool {
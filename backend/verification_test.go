@@ -63,3 +63,59 @@ func TestMakeVerifyCodeUnique(t *testing.T) {
 		tokens = append(tokens, prevToken)
 	}
 }
+
+func TestCodeFormat(t *testing.T) {
+	// The default format keeps making the same codes as before it was configurable
+	if code := MakeVerifyCodeTS(signingKey, email, time.Unix(1700000000, 0).UTC()); code != "QVYNKSL9" {
+		t.Errorf("Default format made code %s, expected QVYNKSL9", code)
+	}
+
+	digits := newCodeFormat(CodeConfig{Alphabet: "0123456789", Length: 8, WindowMinutes: 10, ValidWindows: 3})
+	if err := digits.check(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	code := digits.make(signingKey, email, now)
+	if len(code) != 8 || strings.Trim(code, "0123456789") != "" {
+		t.Errorf("Digits format made code %s", code)
+	}
+
+	if !digits.valid(code) || digits.valid(code+"1") || digits.valid("ABCDEFGH") {
+		t.Error("Digits format validity check failed")
+	}
+
+	if !digits.verify(code, signingKey, email, now.Add(20*time.Minute)) {
+		t.Error("Code from the third valid window was not accepted")
+	}
+
+	if digits.verify(code, signingKey, email, now.Add(30*time.Minute)) {
+		t.Error("Code from before the valid windows was accepted")
+	}
+
+	if digits.validity() != 30*time.Minute {
+		t.Errorf("Got validity %s, expected 30m", digits.validity())
+	}
+}
+
+func TestCodeFormatCheck(t *testing.T) {
+	invalid := []CodeConfig{
+		{Alphabet: "0123456789", Length: 6},
+		{Alphabet: "AB", Length: 16},
+		{Alphabet: "AABCDEFGHIJKLMNOP"},
+		{Alphabet: "abcdefghijklmnop"},
+		{Alphabet: "ABCD EFGHIJKLMNOP"},
+		{ValidWindows: 10, Length: 6},
+		{ValidWindows: 1},
+	}
+
+	for _, config := range invalid {
+		if err := newCodeFormat(config).check(); err == nil {
+			t.Errorf("Code format %+v was accepted", config)
+		}
+	}
+
+	if err := defaultCodeFormat.check(); err != nil {
+		t.Errorf("Default code format was rejected: %s", err)
+	}
+}
@@ -2,19 +2,212 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/cocreators-ee/praga/backend"
+	"github.com/goccy/go-yaml"
 )
 
-var config = flag.String("config", "praga.yaml", "Path to praga yaml configuration file")
+var (
+	config = flag.String("config", "praga.yaml", "Path to praga yaml configuration file")
+	debug  = flag.Bool("debug", false, "Enable debug logging, overriding log.level from the configuration")
+)
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  serve     Run the server (default)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  expiring  List allowlist entries expiring soon\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  invite    Create an invitation link for an email\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  policy test  Evaluate the access policy against sample inputs\n\nFlags:\n")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+
 	ok, c := backend.LoadConfig(*config)
 	if !ok {
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "", "serve":
+		serve(c)
+	case "expiring":
+		expiring(c, flag.Args()[1:])
+	case "invite":
+		invite(c, flag.Args()[1:])
+	case "policy":
+		if flag.Arg(1) != "test" {
+			flag.Usage()
+			os.Exit(2)
+		}
+		policyTest(c, flag.Args()[2:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func serve(c backend.Config) {
+	srv := backend.NewServer(c, *debug)
+	srv.ConfigPath = *config
+	if err := srv.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Server failed: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// expiring lists the allowlist entries expiring within the given number of days, and those already expired
+func expiring(c backend.Config, args []string) {
+	flags := flag.NewFlagSet("expiring", flag.ExitOnError)
+	days := flags.Int("days", 14, "List entries expiring within this many days")
+	_ = flags.Parse(args)
+
+	now := time.Now()
+	entries := backend.ExpiringEntries(c, now.AddDate(0, 0, *days))
+	if len(entries) == 0 {
+		fmt.Printf("No entries expiring within %d days\n", *days)
 		return
 	}
 
-	srv := backend.NewServer(c)
-	srv.Start()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ENTRY\tGROUP\tVALID UNTIL\tSTATUS")
+	for _, entry := range entries {
+		status := "expiring"
+		if !entry.ValidUntil.After(now) {
+			status = "expired"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.Entry, entry.Group, entry.ValidUntil.Format(time.RFC3339), status)
+	}
+	_ = w.Flush()
+}
+
+// invite prints a link inviting the email to log in, adding it to the dynamic allowlist once followed
+func invite(c backend.Config, args []string) {
+	flags := flag.NewFlagSet("invite", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s [flags] invite [invite flags] email\n\nInvite flags:\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	groups := flags.String("groups", "", "Comma separated groups from the configuration to invite the email to")
+	days := flags.Int("days", 7, "Days the invitation link is valid for, at most 365")
+	accessDays := flags.Int("access-days", 0, "Days the access is valid for once accepted, 0 for no limit")
+	_ = flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	invitation := &backend.Invitation{
+		Email:      flags.Arg(0),
+		AccessDays: *accessDays,
+		InvitedBy:  "command line",
+	}
+	if *groups != "" {
+		invitation.Groups = strings.Split(*groups, ",")
+	}
+
+	expires := time.Now().AddDate(0, 0, *days)
+	link, err := backend.MakeInvitation(&backend.Server{Config: c}, invitation, expires)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create invitation: %s\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%s\n\nValid until %s, cancel with DELETE /api/admin/invitations/%s\n", link, expires.Format(time.RFC3339), invitation.ID)
+}
+
+// policySample is an input for testing the access policy, with the decision it is expected to get
+type policySample struct {
+	backend.PolicyInput `yaml:",inline"`
+	Expect              string `yaml:"expect"`
+}
+
+// policyTest evaluates the access policy against the input given in flags, or the samples in a YAML file, exiting
+// with an error if any sample does not get the decision it expects
+func policyTest(c backend.Config, args []string) {
+	flags := flag.NewFlagSet("policy test", flag.ExitOnError)
+	file := flags.String("file", "", "YAML file with a list of sample inputs, each optionally with expect: allow or deny")
+	email := flags.String("email", "user@example.com", "Email of the user")
+	groups := flags.String("groups", "", "Comma separated groups of the user")
+	host := flags.String("host", "", "Host being accessed")
+	path := flags.String("path", "/", "Path being accessed")
+	method := flags.String("method", "GET", "HTTP method of the request")
+	ip := flags.String("ip", "127.0.0.1", "Client IP address")
+	at := flags.String("time", "", "Time of the request in RFC 3339 format, defaults to now")
+	_ = flags.Parse(args)
+
+	var samples []policySample
+	if *file != "" {
+		contents, err := os.ReadFile(*file)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to read samples: %s\n", err)
+			os.Exit(1)
+		}
+		if err := yaml.Unmarshal(contents, &samples); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to parse samples: %s\n", err)
+			os.Exit(1)
+		}
+	} else {
+		sample := policySample{PolicyInput: backend.PolicyInput{Email: *email, Host: *host, Path: *path, Method: *method, IP: *ip}}
+		if *groups != "" {
+			sample.Groups = strings.Split(*groups, ",")
+		}
+		if *at != "" {
+			t, err := time.Parse(time.RFC3339, *at)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Invalid time: %s\n", err)
+				os.Exit(2)
+			}
+			sample.Time = t
+		}
+		samples = append(samples, sample)
+	}
+
+	failed := false
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SAMPLE\tRULE\tRESULT")
+	for i, sample := range samples {
+		if sample.Time.IsZero() {
+			sample.Time = time.Now()
+		}
+
+		results, err := backend.EvaluatePolicy(c, sample.PolicyInput)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid access policy: %s\n", err)
+			os.Exit(1)
+		}
+
+		name := fmt.Sprintf("%d %s %s%s", i+1, sample.Email, sample.Host, sample.Path)
+		decision := "allow"
+		for _, result := range results {
+			status := "allow"
+			if result.Err != nil {
+				status = "error: " + result.Err.Error()
+			} else if !result.Allow {
+				status = "deny"
+			}
+			if status != "allow" {
+				decision = "deny"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, result.Rule, status)
+		}
+
+		if sample.Expect != "" && sample.Expect != decision {
+			failed = true
+			fmt.Fprintf(w, "%s\t\t%s, expected %s\n", name, decision, sample.Expect)
+		} else {
+			fmt.Fprintf(w, "%s\t\t%s\n", name, decision)
+		}
+	}
+	_ = w.Flush()
+
+	if failed {
+		os.Exit(1)
+	}
 }
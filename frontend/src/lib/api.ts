@@ -1,16 +1,67 @@
 interface EmailVerifyRequest {
   email: string
   code: string
+  target?: string
 }
 
 interface EmailSendRequest {
   email: string
+  target?: string
+}
+
+interface AccessRequestRequest {
+  email: string
+  reason: string
+}
+
+interface AccessDecideRequest {
+  token: string
+}
+
+interface InvitationRequest {
+  token: string
 }
 
 export interface ConfigResponse {
   title: string
   brand: string
   support: string
+  sessions: boolean
+  code: CodeFormat
+  access_requests: boolean
+}
+
+export interface CodeFormat {
+  alphabet: string
+  length: number
+}
+
+export interface Session {
+  id: string
+  issued_at: string
+  last_seen: string
+  ip: string
+  user_agent: string
+  current: boolean
+}
+
+export interface AccessDecision {
+  email: string
+  reason: string
+  created: string
+  approve: boolean
+  valid_until?: string
+}
+
+export interface Invitation {
+  email: string
+  groups?: string[]
+  valid_until?: string
+}
+
+export interface SessionsResponse {
+  email: string
+  sessions: Session[]
 }
 
 const credentials = "same-origin"
@@ -33,8 +84,8 @@ export async function verifyToken(): Promise<boolean> {
   return response.ok
 }
 
-export async function emailVerify(email: string, code: string): Promise<boolean> {
-  const payload: EmailVerifyRequest = {email, code}
+export async function emailVerify(email: string, code: string, target?: string): Promise<boolean> {
+  const payload: EmailVerifyRequest = {email, code, target}
   const response = await fetch(`/api/email/verify`, {
     method: "post",
     credentials: credentials,
@@ -44,11 +95,89 @@ export async function emailVerify(email: string, code: string): Promise<boolean>
   return response.ok
 }
 
-export async function emailSend(email: string) {
-  const payload: EmailSendRequest = {email}
+export async function emailSend(email: string, target?: string) {
+  const payload: EmailSendRequest = {email, target}
   await fetch(`/api/email/send`, {
     method: "post",
     credentials: credentials,
     body: JSON.stringify(payload),
   })
 }
+
+export async function getSessions(): Promise<SessionsResponse | undefined> {
+  const response = await fetch(`/api/sessions`, {
+    method: "get",
+    credentials: credentials,
+  })
+
+  if (!response.ok) {
+    return undefined
+  }
+  return response.json()
+}
+
+export async function revokeSession(id: string): Promise<boolean> {
+  const response = await fetch(`/api/sessions/${encodeURIComponent(id)}`, {
+    method: "delete",
+    credentials: credentials,
+  })
+
+  return response.ok
+}
+
+export async function requestAccess(email: string, reason: string): Promise<boolean> {
+  const payload: AccessRequestRequest = {email, reason}
+  const response = await fetch(`/api/access/request`, {
+    method: "post",
+    credentials: credentials,
+    body: JSON.stringify(payload),
+  })
+
+  return response.ok
+}
+
+export async function getAccessDecision(token: string): Promise<AccessDecision | undefined> {
+  const response = await fetch(`/api/access/decision?token=${encodeURIComponent(token)}`, {
+    method: "get",
+    credentials: credentials,
+  })
+
+  if (!response.ok) {
+    return undefined
+  }
+  return response.json()
+}
+
+export async function decideAccess(token: string): Promise<boolean> {
+  const payload: AccessDecideRequest = {token}
+  const response = await fetch(`/api/access/decide`, {
+    method: "post",
+    credentials: credentials,
+    body: JSON.stringify(payload),
+  })
+
+  return response.ok
+}
+
+export async function getInvitation(token: string): Promise<Invitation | undefined> {
+  const response = await fetch(`/api/invitations?token=${encodeURIComponent(token)}`, {
+    method: "get",
+    credentials: credentials,
+  })
+
+  if (!response.ok) {
+    return undefined
+  }
+  return response.json()
+}
+
+export async function acceptInvitation(token: string): Promise<boolean> {
+  const payload: InvitationRequest = {token}
+  const response = await fetch(`/api/invitations/accept`, {
+    method: "post",
+    credentials: credentials,
+    body: JSON.stringify(payload),
+  })
+
+  return response.ok
+}
@@ -0,0 +1,2 @@
+// Build as access/index.html so the backend file server finds it at /access/
+export const trailingSlash = "always"
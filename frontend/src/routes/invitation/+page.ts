@@ -0,0 +1,2 @@
+// Build as invitation/index.html so the backend file server finds it at /invitation/
+export const trailingSlash = "always"
@@ -0,0 +1,2 @@
+// Build as request-access/index.html so the backend file server finds it at /request-access/
+export const trailingSlash = "always"
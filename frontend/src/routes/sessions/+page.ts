@@ -0,0 +1,2 @@
+// Build as sessions/index.html so the backend file server finds it at /sessions/
+export const trailingSlash = "always"